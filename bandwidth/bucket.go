@@ -0,0 +1,293 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// tokenBucket is a token bucket rate limiter where one token is one byte.
+// It works like rate.Limiter, but it also allows for returning a part of reserved tokens,
+// so only bytes which were really transferred are charged.
+type tokenBucket struct {
+	mutex sync.Mutex
+	limit rate.Limit
+	burst int
+	// tokens is a number of available tokens at time last.
+	// It is negative when tokens have been reserved in advance.
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns full token bucket for a given config.
+// The bucket starts collecting tokens when it is used for the first time,
+// so it does not depend on a clock.
+func newTokenBucket(c Config) *tokenBucket {
+	return &tokenBucket{
+		limit:  c.limit,
+		burst:  c.burst,
+		tokens: float64(c.burst),
+	}
+}
+
+// limiter is a rate limiter, which allows for operating on bytes.
+type limiter interface {
+	// Burst returns the maximum number of bytes which can be reserved at once.
+	Burst() int
+	// waitN blocks until n bytes can be used, the context is done, or the deadline is exceeded.
+	// It returns reservation, so unused bytes can be returned.
+	waitN(ctx context.Context, clock Clock, dl *deadline, n int) (*Reservation, error)
+}
+
+// reserver reserves bytes without waiting.
+type reserver interface {
+	// ReserveN reserves n bytes at time now.
+	ReserveN(now time.Time, n int) (*Reservation, error)
+}
+
+// reserveAndWait reserves n bytes and waits until they can be used.
+// Reserved bytes are returned when waiting fails.
+func reserveAndWait(ctx context.Context, clock Clock, dl *deadline, rv reserver, n int) (*Reservation, error) {
+	r, err := rv.ReserveN(clock.Now(), n)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.wait(ctx, clock, dl); err != nil {
+		r.Cancel()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reservation holds bytes reserved in limiters. It says when bytes can be used,
+// and it allows for returning bytes which have not been used.
+type Reservation struct {
+	// refunds are called with returned tokens, one for each limiter where the same number of tokens has been reserved.
+	refunds []func(n int)
+	// tokens is a number of reserved tokens which have not been returned yet.
+	tokens int
+	// timeToAct is a time when reserved tokens can be used.
+	timeToAct time.Time
+	// waited is true when reserved tokens have not been available immediately, so they have been waited for.
+	waited bool
+}
+
+// Config returns current config of the token bucket.
+func (tb *tokenBucket) Config() Config {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	return Config{limit: tb.limit, burst: tb.burst}
+}
+
+// SetConfig sets new limit and burst.
+// Tokens which have been already reserved are not affected.
+func (tb *tokenBucket) SetConfig(now time.Time, c Config) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.advance(now)
+	tb.limit = c.limit
+	tb.burst = c.burst
+}
+
+// IsFull returns true when the token bucket is full at time now, so it behaves like a new one.
+func (tb *tokenBucket) IsFull(now time.Time) bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if tb.limit == rate.Inf {
+		return true
+	}
+
+	tokens := tb.tokens
+	if now.After(tb.last) {
+		tokens += now.Sub(tb.last).Seconds() * float64(tb.limit)
+	}
+
+	return tokens >= float64(tb.burst)
+}
+
+// ReserveN reserves n tokens at time now.
+// Returned reservation says when tokens can be used.
+// It returns an error when n exceeds the burst, because such reservation could never be fulfilled.
+func (tb *tokenBucket) ReserveN(now time.Time, n int) (*Reservation, error) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	r := &Reservation{refunds: []func(n int){tb.ReturnN}, tokens: n, timeToAct: now}
+	if tb.limit == rate.Inf {
+		return r, nil
+	}
+
+	if n > tb.burst {
+		return nil, fmt.Errorf("bandwidth: can not reserve %d bytes, because it exceeds burst %d", n, tb.burst)
+	}
+
+	tb.advance(now)
+	tb.tokens -= float64(n)
+	if tb.tokens < 0 {
+		r.timeToAct = now.Add(durationFromTokens(tb.limit, -tb.tokens))
+	}
+
+	return r, nil
+}
+
+// Delay returns how long it takes until n tokens are available at time now.
+// It returns zero when n exceeds the burst, because such reservation fails immediately.
+func (tb *tokenBucket) Delay(now time.Time, n int) time.Duration {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if tb.limit == rate.Inf || n > tb.burst {
+		return 0
+	}
+
+	tb.advance(now)
+	if missing := float64(n) - tb.tokens; missing > 0 {
+		return durationFromTokens(tb.limit, missing)
+	}
+
+	return 0
+}
+
+// ReturnN returns n tokens into the token bucket.
+// Tokens are capped by the burst, and the result is the same as if tokens collected since last time
+// were added first, so the current time is not needed.
+func (tb *tokenBucket) ReturnN(n int) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if tb.limit == rate.Inf {
+		return
+	}
+
+	tb.tokens = math.Min(tb.tokens+float64(n), float64(tb.burst))
+}
+
+// advance adds tokens which have been collected since last time.
+// It requires that mutex is held.
+func (tb *tokenBucket) advance(now time.Time) {
+	if tb.last.IsZero() {
+		// The bucket is used for the first time, so it is still full.
+		tb.last = now
+		return
+	}
+	if now.Before(tb.last) {
+		// Other goroutine has already advanced the bucket.
+		return
+	}
+
+	if tb.limit == rate.Inf {
+		// Infinite limit fills the bucket immediately, so it is full when the limit is changed.
+		tb.tokens = float64(tb.burst)
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * float64(tb.limit)
+		tb.tokens = math.Min(tb.tokens, float64(tb.burst))
+	}
+	tb.last = now
+}
+
+// durationFromTokens returns how long it takes to collect tokens with a given limit.
+func durationFromTokens(limit rate.Limit, tokens float64) time.Duration {
+	return time.Duration(tokens / float64(limit) * float64(time.Second))
+}
+
+// Wait blocks until reserved tokens can be used or the context is done.
+// When the context is done then its cause is returned.
+// It returns an error immediately when tokens can not be used before the context's deadline.
+// When a given deadline is exceeded, or it is obvious that it would be exceeded,
+// then os.ErrDeadlineExceeded is returned, so it can be used by net.Conn. Deadline can be nil.
+func (r *Reservation) wait(ctx context.Context, clock Clock, dl *deadline) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	for {
+		t, deadlineChanged := dl.Get()
+		if !t.IsZero() && t.Before(r.timeToAct) {
+			return os.ErrDeadlineExceeded
+		}
+
+		delay := r.timeToAct.Sub(clock.Now())
+		if delay <= 0 {
+			return nil
+		}
+
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(r.timeToAct) {
+			return fmt.Errorf("bandwidth: waiting for %d bytes would exceed context deadline: %w",
+				r.tokens, context.DeadlineExceeded)
+		}
+
+		r.waited = true
+		if r.waitFor(ctx, clock, delay, deadlineChanged) {
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// waitFor waits for a given delay.
+// It is interrupted when the context is done or deadline is changed.
+// It returns true when the context is done.
+func (r *Reservation) waitFor(ctx context.Context, clock Clock, delay time.Duration,
+	deadlineChanged <-chan struct{}) bool {
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return false
+	case <-deadlineChanged:
+		return false
+	case <-ctx.Done():
+		return true
+	}
+}
+
+// DelayFrom returns how long it takes from time now until reserved bytes can be used.
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	return max(r.timeToAct.Sub(now), 0)
+}
+
+// ReturnN returns n unused bytes into limiters.
+// It never returns more bytes than it has been reserved.
+func (r *Reservation) ReturnN(n int) {
+	n = min(n, r.tokens)
+	if n <= 0 {
+		return
+	}
+
+	r.tokens -= n
+	for _, refund := range r.refunds {
+		refund(n)
+	}
+}
+
+// Cancel returns all reserved bytes which have not been returned yet.
+func (r *Reservation) Cancel() {
+	r.ReturnN(r.tokens)
+}
+
+// reservations is a list of reservations made in different token buckets for one operation.
+type reservations []*Reservation
+
+// ReturnN returns n unused tokens into all token buckets.
+func (rs reservations) ReturnN(n int) {
+	for _, r := range rs {
+		r.ReturnN(n)
+	}
+}
+
+// Cancel returns all reserved tokens into all token buckets.
+func (rs reservations) Cancel() {
+	for _, r := range rs {
+		r.Cancel()
+	}
+}
@@ -0,0 +1,173 @@
+package bandwidth
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestTokenBucketReserveN(t *testing.T) {
+	tb := newTokenBucket(NewConfig(10))
+	now := time.Now()
+
+	// Bucket is full at the beginning.
+	r, err := tb.ReserveN(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct)
+
+	// Next bytes must be collected.
+	r, err = tb.ReserveN(now, 5)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(500*time.Millisecond), r.timeToAct)
+
+	// Reservations in advance are queued.
+	r, err = tb.ReserveN(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(1500*time.Millisecond), r.timeToAct)
+
+	_, err = tb.ReserveN(now, 11)
+	require.Error(t, err, "it must not be possible to reserve more than burst")
+}
+
+func TestTokenBucketReturnN(t *testing.T) {
+	tb := newTokenBucket(NewConfig(10))
+	now := time.Now()
+
+	_, err := tb.ReserveN(now, 10)
+	require.NoError(t, err)
+	tb.ReturnN(4)
+
+	r, err := tb.ReserveN(now, 4)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct, "returned bytes must be available immediately")
+
+	// Returned tokens can not exceed burst.
+	tb.ReturnN(100)
+	assert.Equal(t, float64(10), tb.tokens)
+}
+
+func TestTokenBucketDelay(t *testing.T) {
+	tb := newTokenBucket(NewConfig(10))
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), tb.Delay(now, 10))
+	_, err := tb.ReserveN(now, 6)
+	require.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, tb.Delay(now, 6))
+	assert.Equal(t, time.Duration(0), tb.Delay(now, 11), "reservation exceeding burst fails immediately")
+	assert.Equal(t, time.Duration(0), newTokenBucket(NewUnlimitedConfig()).Delay(now, 100))
+}
+
+func TestTokenBucketAdvance(t *testing.T) {
+	tb := newTokenBucket(NewConfig(10))
+	now := time.Now()
+
+	_, err := tb.ReserveN(now, 10)
+	require.NoError(t, err)
+
+	r, err := tb.ReserveN(now.Add(300*time.Millisecond), 3)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(300*time.Millisecond), r.timeToAct, "3 bytes should be collected after 300ms")
+
+	// Collected bytes can not exceed burst.
+	_, err = tb.ReserveN(now.Add(time.Hour), 0)
+	require.NoError(t, err)
+	assert.Equal(t, float64(10), tb.tokens)
+}
+
+func TestTokenBucketSetConfig(t *testing.T) {
+	tb := newTokenBucket(NewUnlimitedConfig())
+	now := time.Now()
+
+	r, err := tb.ReserveN(now, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct)
+
+	// Bucket is full when infinite limit is changed.
+	tb.SetConfig(now, NewConfig(10))
+	assert.Equal(t, NewConfig(10), tb.Config())
+	assert.Equal(t, 10, tb.Config().burst)
+	r, err = tb.ReserveN(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct)
+
+	tb.SetConfig(now, NewConfig(rate.Inf))
+	r, err = tb.ReserveN(now, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct)
+}
+
+func TestReservation(t *testing.T) {
+	tb := newTokenBucket(NewConfig(10))
+
+	r, err := tb.ReserveN(time.Now(), 10)
+	require.NoError(t, err)
+	require.NoError(t, r.wait(context.Background(), systemClock{}, nil))
+	r.ReturnN(3)
+	assert.Equal(t, 7, r.tokens)
+	r.Cancel()
+	assert.Equal(t, 0, r.tokens)
+	r.Cancel()
+	assert.InDelta(t, float64(10), tb.tokens, 0.1, "only reserved bytes can be returned")
+
+	// Context's deadline which would be exceeded fails immediately.
+	_, err = tb.ReserveN(time.Now(), 10)
+	require.NoError(t, err)
+	r, err = tb.ReserveN(time.Now(), 10)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, r.wait(ctx, systemClock{}, nil), context.DeadlineExceeded)
+
+	// Canceled context interrupts waiting.
+	r, err = tb.ReserveN(time.Now(), 10)
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	require.ErrorIs(t, r.wait(ctx, systemClock{}, nil), context.Canceled)
+}
+
+func TestReservationWithDeadline(t *testing.T) {
+	tb := newTokenBucket(NewConfig(10))
+	_, err := tb.ReserveN(time.Now(), 10)
+	require.NoError(t, err)
+
+	t.Run("deadline would be exceeded", func(t *testing.T) {
+		r, err := tb.ReserveN(time.Now(), 1)
+		require.NoError(t, err)
+		defer r.Cancel()
+
+		dl := &deadline{}
+		dl.Set(time.Now().Add(time.Millisecond))
+		start := time.Now()
+		require.ErrorIs(t, r.wait(context.Background(), systemClock{}, dl), os.ErrDeadlineExceeded)
+		assert.Less(t, time.Since(start), 10*time.Millisecond, "it must fail immediately")
+	})
+
+	t.Run("deadline is changed while waiting", func(t *testing.T) {
+		r, err := tb.ReserveN(time.Now(), 10)
+		require.NoError(t, err)
+		defer r.Cancel()
+
+		dl := &deadline{}
+		dl.Set(time.Now().Add(time.Hour))
+		time.AfterFunc(10*time.Millisecond, func() {
+			dl.Set(time.Now())
+		})
+		require.ErrorIs(t, r.wait(context.Background(), systemClock{}, dl), os.ErrDeadlineExceeded)
+	})
+
+	t.Run("deadline is not exceeded", func(t *testing.T) {
+		r, err := tb.ReserveN(time.Now(), 1)
+		require.NoError(t, err)
+
+		dl := &deadline{}
+		dl.Set(time.Now().Add(time.Hour))
+		require.NoError(t, r.wait(context.Background(), systemClock{}, dl))
+	})
+}
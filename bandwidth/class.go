@@ -0,0 +1,127 @@
+package bandwidth
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// Classifier returns a name of a traffic class for an accepted connection, e.g. "internal" or "anonymous".
+// It can be based on remote address, local port or TLS server name. When the bandwidth listener wraps
+// a TLS listener, then the connection can be asserted to *tls.Conn, so the handshake can be completed
+// and ConnectionState().ServerName can be used. Keep in mind that Accept is blocked until classifier returns.
+// Empty name means that the connection does not belong to any class.
+type Classifier func(conn net.Conn) string
+
+// class is a traffic class. It keeps a rate limiter shared by all connections of the class
+// and a limit config for each connection of the class.
+type class struct {
+	limitGroup
+	// bypassGlobal is true when connections of the class are not limited by global limiter.
+	bypassGlobal bool
+	// traffic counts traffic of connections of the class.
+	traffic traffic
+}
+
+// BypassGlobal returns true when connections of the class are not limited by global limiter.
+func (cl *class) BypassGlobal() bool {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+
+	return cl.bypassGlobal
+}
+
+func (cl *class) setBypassGlobal(bypass bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.bypassGlobal = bypass
+}
+
+// classes keeps traffic classes by their names.
+type classes struct {
+	mutex      sync.Mutex
+	classifier Classifier
+	byName     map[string]*class
+	// clock is used by limiters of new classes.
+	clock Clock
+	// newLimiter creates limiters of new classes.
+	newLimiter LimiterFactory
+	// traffic counts traffic of all classes. It is nil when traffic of classes is not counted elsewhere.
+	traffic *traffic
+	// onConnChange is called when connection config of a class is changed. It can be nil.
+	onConnChange func()
+}
+
+func newClasses() *classes {
+	return &classes{
+		byName:     make(map[string]*class),
+		clock:      systemClock{},
+		newLimiter: newBucketLimiter,
+	}
+}
+
+// Get returns a class with a given name.
+// When the class does not exist, then new unlimited class is created.
+func (cs *classes) Get(name string) *class {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cl, ok := cs.byName[name]
+	if !ok {
+		cl = &class{}
+		// Connection limit of a new class is inherited from the listener.
+		cl.init(cs.clock, cs.newLimiter, Config{})
+		cl.onConnChange = cs.onConnChange
+		if cs.traffic != nil {
+			cl.traffic.setParent(cs.traffic)
+		}
+		cs.byName[name] = cl
+	}
+
+	return cl
+}
+
+// inheritedChanged informs connections of all classes that connection config of the listener has been changed.
+func (cs *classes) inheritedChanged() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for _, cl := range cs.byName {
+		cl.inheritedChanged()
+	}
+}
+
+// Names returns sorted names of all classes.
+func (cs *classes) Names() []string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	names := make([]string, 0, len(cs.byName))
+	for name := range cs.byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Classify returns a name of a class and the class for a given connection.
+// It returns false when classifier is not set, or the connection does not belong to any class.
+func (cs *classes) Classify(conn net.Conn) (string, *class, bool) {
+	cs.mutex.Lock()
+	classifier := cs.classifier
+	cs.mutex.Unlock()
+
+	if classifier == nil {
+		return "", nil, false
+	}
+
+	// Classifier is called without mutex, because it can take a while, e.g. TLS handshake.
+	name := classifier(conn)
+	if name == "" {
+		return "", nil, false
+	}
+
+	return name, cs.Get(name), true
+}
@@ -0,0 +1,48 @@
+package bandwidth
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassesGet(t *testing.T) {
+	cs := newClasses()
+	cl := cs.Get("internal")
+	assert.Same(t, cl, cs.Get("internal"))
+	assert.NotSame(t, cl, cs.Get("anonymous"))
+
+	_, connCfg := cl.GetConnCfg()
+	unlimited := NewUnlimitedConfig()
+	assert.Equal(t, [directions]Config{}, connCfg, "new class must inherit connection limits")
+	classCfg, _ := cl.getLimits(writeDirection)
+	assert.Equal(t, unlimited, classCfg)
+	assert.False(t, cl.BypassGlobal())
+
+	cl.setBypassGlobal(true)
+	assert.True(t, cs.Get("internal").BypassGlobal())
+}
+
+func TestClassesClassify(t *testing.T) {
+	cs := newClasses()
+	_, _, ok := cs.Classify(mockConn{})
+	require.False(t, ok, "classifier is not set")
+
+	cs.classifier = func(conn net.Conn) string {
+		if conn.RemoteAddr().String() == "10.0.0.1:80" {
+			return "internal"
+		}
+
+		return ""
+	}
+
+	name, cl, ok := cs.Classify(mockAddrConn{addr: mockAddr("10.0.0.1:80")})
+	require.True(t, ok)
+	assert.Equal(t, "internal", name)
+	assert.Same(t, cs.Get("internal"), cl)
+
+	_, _, ok = cs.Classify(mockAddrConn{addr: mockAddr("10.0.0.2:80")})
+	require.False(t, ok, "connection does not belong to any class")
+}
@@ -0,0 +1,188 @@
+package bandwidth
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it.
+// It can be replaced, e.g. in tests, so they do not have to wait for real time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer returns a timer which sends the current time on its channel after at least a given duration.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event created by Clock.
+type Timer interface {
+	// C returns a channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false when the timer has already fired or been stopped.
+	Stop() bool
+}
+
+// systemClock is a clock which uses real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// systemTimer is a timer which uses real time.
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// FakeClock is a clock which time is moved only by Advance, so tests can check exact timings
+// without waiting for real time. It is safe for concurrent use.
+//
+// Goroutines waiting for limiters create timers, so tests should call BlockUntil before Advance
+// to make sure that goroutines are already waiting. Goroutines woken by Advance see the time after
+// the whole advance, so time should be advanced in steps when it matters.
+type FakeClock struct {
+	mutex sync.Mutex
+	// changed is signaled when a timer is created.
+	changed *sync.Cond
+	now     time.Time
+	timers  []*fakeTimer
+}
+
+// fakeTimer is a timer of a fake clock.
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+// NewFakeClock returns a fake clock which starts at a given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.changed = sync.NewCond(&c.mutex)
+
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// NewTimer returns a timer which fires when the clock is advanced by a given duration.
+// Timer with non-positive duration fires immediately.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer
+	}
+
+	c.timers = append(c.timers, timer)
+	c.changed.Broadcast()
+
+	return timer
+}
+
+// Advance moves time forward by a given duration and fires timers which are due, in order of their times.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.advanceTo(c.now.Add(d))
+}
+
+// advanceTo moves time to a given time and fires timers which are due. The mutex must be held.
+func (c *FakeClock) advanceTo(now time.Time) {
+	c.now = now
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+
+	waiting := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			waiting = append(waiting, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = waiting
+}
+
+// BlockUntil blocks until at least n timers are waiting, e.g. until n goroutines wait for limiters.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.timers) < n {
+		c.changed.Wait()
+	}
+}
+
+// Waiting returns the number of waiting timers, and the time when the earliest of them fires.
+// The time is zero when no timer is waiting.
+func (c *FakeClock) Waiting() (n int, next time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.timers), c.next()
+}
+
+// AdvanceToNextTimer moves time forward to the earliest waiting timer, and fires timers which are due.
+// It returns false and does not move time when no timer is waiting.
+func (c *FakeClock) AdvanceToNextTimer() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.timers) == 0 {
+		return false
+	}
+	c.advanceTo(c.next())
+
+	return true
+}
+
+// next returns the time when the earliest waiting timer fires. The mutex must be held.
+func (c *FakeClock) next() time.Time {
+	var next time.Time
+	for _, timer := range c.timers {
+		if next.IsZero() || timer.at.Before(next) {
+			next = timer.at
+		}
+	}
+
+	return next
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
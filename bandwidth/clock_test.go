@@ -0,0 +1,88 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClockTimers(t *testing.T) {
+	start := time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	immediate := clock.NewTimer(0)
+	assert.Equal(t, start, <-immediate.C(), "timer without duration must fire immediately")
+
+	first := clock.NewTimer(time.Second)
+	second := clock.NewTimer(2 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop(), "timer can be stopped once")
+	clock.BlockUntil(2)
+
+	clock.Advance(1500 * time.Millisecond)
+	assert.Equal(t, start.Add(1500*time.Millisecond), clock.Now())
+	assert.Equal(t, start.Add(1500*time.Millisecond), <-first.C())
+	assert.False(t, first.Stop(), "fired timer can not be stopped")
+	select {
+	case <-second.C():
+		assert.Fail(t, "timer must not fire before its time")
+	case <-stopped.C():
+		assert.Fail(t, "stopped timer must not fire")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(2500*time.Millisecond), <-second.C())
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	waiting := make(chan struct{})
+	go func() {
+		clock.BlockUntil(1)
+		close(waiting)
+	}()
+
+	select {
+	case <-waiting:
+		assert.Fail(t, "it must block until a timer is created")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.NewTimer(time.Second)
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		assert.Fail(t, "it must return when a timer is created")
+	}
+}
+
+func TestFakeClockAdvanceToNextTimer(t *testing.T) {
+	start := time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	n, next := clock.Waiting()
+	assert.Zero(t, n)
+	assert.True(t, next.IsZero())
+	assert.False(t, clock.AdvanceToNextTimer(), "time must not move without timers")
+	assert.Equal(t, start, clock.Now())
+
+	later := clock.NewTimer(2 * time.Second)
+	earlier := clock.NewTimer(time.Second)
+	n, next = clock.Waiting()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, start.Add(time.Second), next)
+
+	assert.True(t, clock.AdvanceToNextTimer())
+	assert.Equal(t, start.Add(time.Second), <-earlier.C())
+	n, next = clock.Waiting()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, start.Add(2*time.Second), next)
+
+	assert.True(t, clock.AdvanceToNextTimer())
+	assert.Equal(t, start.Add(2*time.Second), <-later.C())
+	assert.Equal(t, start.Add(2*time.Second), clock.Now())
+}
@@ -1,48 +1,149 @@
 package bandwidth
 
 import (
+	"errors"
+	"fmt"
 	"math"
 
 	"golang.org/x/time/rate"
 )
 
-type config struct {
+// Config is a limit of bytes per second with a burst, and an algorithm of limiters which enforce it.
+// Configs should be created by NewConfig, NewStrictConfig or ParseConfig. Zero Config is not valid,
+// but it is a missing limit, so limiters treat it as unlimited.
+type Config struct {
 	limit rate.Limit
 	burst int
+	// algorithm is an algorithm of limiters created for the config.
+	algorithm Algorithm
 }
 
 // NewConfig creates new config limiter for given limit and optional burst.
-// When burst is not provided, or it is <=0 then it be the same as limit.
-func NewConfig(limit rate.Limit, burst ...int) config {
+// When burst is not provided, or it is <=0 then it be the same as limit, but at least 1 byte.
+// Limit <=0 means unlimited. Use NewStrictConfig to get an error for such values instead.
+func NewConfig(limit rate.Limit, burst ...int) Config {
 	if limit <= 0 || limit == rate.Inf {
-		return config{limit: rate.Inf, burst: math.MaxInt}
+		return Config{limit: rate.Inf, burst: math.MaxInt}
 	}
 
-	c := config{
+	c := Config{
 		limit: limit,
 	}
 	if len(burst) > 0 && burst[0] > 0 {
 		c.burst = burst[0]
 	} else {
-		// Rate limiter will not work with burst 0 and limit > 0, unless limit is Inf.
-		c.burst = int(limit)
+		c.burst = defaultBurst(limit)
+	}
+
+	return c
+}
+
+// NewStrictConfig creates new config for given limit and burst, and it returns an error when they are invalid.
+// Limit must be positive, and rate.Inf means unlimited. Zero burst means the same as limit, but at least 1 byte,
+// and unlimited config can not have burst.
+func NewStrictConfig(limit rate.Limit, burst int) (Config, error) {
+	if limit == rate.Inf {
+		if burst != 0 {
+			return Config{}, fmt.Errorf("bandwidth: unlimited config can not have burst %d", burst)
+		}
+
+		return NewUnlimitedConfig(), nil
+	}
+
+	c := Config{limit: limit, burst: burst}
+	if burst == 0 && limit > 0 {
+		c.burst = defaultBurst(limit)
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return c, nil
+}
+
+// defaultBurst returns burst of a config without burst, which is the same as limit, but at least 1 byte.
+// Rate limiter will not work with burst 0 and limit > 0, unless limit is Inf.
+func defaultBurst(limit rate.Limit) int {
+	if float64(limit) >= math.MaxInt {
+		return math.MaxInt
+	}
+
+	return max(int(limit), 1)
+}
+
+// Validate returns an error when limiters can not work with the config, e.g. when it is zero Config.
+func (c Config) Validate() error {
+	var errs []error
+	if math.IsNaN(float64(c.limit)) || c.limit <= 0 {
+		errs = append(errs, fmt.Errorf("bandwidth: limit %v must be positive", float64(c.limit)))
+	} else if c.limit != rate.Inf && c.burst <= 0 {
+		errs = append(errs, fmt.Errorf("bandwidth: burst %d must be positive", c.burst))
+	}
+
+	if c.algorithm < TokenBucket || c.algorithm > SlidingWindow {
+		errs = append(errs, fmt.Errorf("bandwidth: unknown algorithm %v", c.algorithm))
+	}
+
+	return errors.Join(errs...)
+}
+
+// orUnlimited returns unlimited config for a missing limit, which is zero Config.
+func orUnlimited(c Config) Config {
+	if c == (Config{}) {
+		return NewUnlimitedConfig()
 	}
 
 	return c
 }
 
 // NewUnlimitedConfig returns new unlimited config.
-func NewUnlimitedConfig() config {
+func NewUnlimitedConfig() Config {
 	return NewConfig(rate.Inf)
 }
 
+// WithAlgorithm returns a copy of the config, which limiters use a given algorithm.
+// By default, limiters are token buckets.
+func (c Config) WithAlgorithm(algorithm Algorithm) Config {
+	c.algorithm = algorithm
+	return c
+}
+
+// Limit returns the maximum rate of bytes per second.
+func (c Config) Limit() rate.Limit {
+	return c.limit
+}
+
+// Burst returns the maximum number of bytes which can be used at once.
+func (c Config) Burst() int {
+	return c.burst
+}
+
+// Algorithm returns an algorithm of limiters created for the config.
+func (c Config) Algorithm() Algorithm {
+	return c.algorithm
+}
+
+// NewLimiter returns new limiter which uses the config's algorithm.
+// Optional clock is used by Limiter.WaitN, e.g. a FakeClock in tests. By default, it is real time.
+func (c Config) NewLimiter(clock ...Clock) Limiter {
+	b := newBucket(c)
+	if len(clock) > 0 {
+		b.clock = clock[0]
+	}
+
+	return b
+}
+
 // NewRateLimiter returns new rate limiter.
-func (c config) NewRateLimiter() *rate.Limiter {
+//
+// Deprecated: it always returns a token bucket, which does not allow for returning unused bytes. Use NewLimiter instead.
+func (c Config) NewRateLimiter() *rate.Limiter {
 	// Validation is not required here, because it was done when object was created.
 	return rate.NewLimiter(c.limit, c.burst)
 }
 
 // IsTheSame returns true if two configs are the same.
-func (c config) IsTheSame(other config) bool {
-	return c.limit == other.limit && c.burst == other.burst
+func (c Config) IsTheSame(other Config) bool {
+	return c.limit == other.limit && c.burst == other.burst && c.algorithm == other.algorithm
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -13,12 +14,12 @@ func TestNewConfig(t *testing.T) {
 	tests := map[string]struct {
 		limit rate.Limit
 		burst []int
-		want  config
+		want  Config
 	}{
 		"infinite config case 1": {
 			limit: -1,
 			burst: nil,
-			want: config{
+			want: Config{
 				limit: rate.Inf,
 				burst: math.MaxInt,
 			},
@@ -26,7 +27,7 @@ func TestNewConfig(t *testing.T) {
 		"infinite config case 2": {
 			limit: 0,
 			burst: []int{1, 2, 3},
-			want: config{
+			want: Config{
 				limit: rate.Inf,
 				burst: math.MaxInt,
 			},
@@ -34,7 +35,7 @@ func TestNewConfig(t *testing.T) {
 		"infinite config case 3": {
 			limit: rate.Inf,
 			burst: []int{20},
-			want: config{
+			want: Config{
 				limit: rate.Inf,
 				burst: math.MaxInt,
 			},
@@ -42,7 +43,7 @@ func TestNewConfig(t *testing.T) {
 		"adjust burst": {
 			limit: 20,
 			burst: nil,
-			want: config{
+			want: Config{
 				limit: 20,
 				burst: 20,
 			},
@@ -50,7 +51,7 @@ func TestNewConfig(t *testing.T) {
 		"valid config": {
 			limit: 20,
 			burst: []int{19},
-			want: config{
+			want: Config{
 				limit: 20,
 				burst: 19,
 			},
@@ -60,6 +61,8 @@ func TestNewConfig(t *testing.T) {
 		t.Run(testName, func(t *testing.T) {
 			c := NewConfig(test.limit, test.burst...)
 			assert.Equal(t, test.want, c)
+			assert.Equal(t, test.want.limit, c.Limit())
+			assert.Equal(t, test.want.burst, c.Burst())
 			r := c.NewRateLimiter()
 			assert.Equal(t, c.limit, r.Limit())
 			assert.Equal(t, c.burst, r.Burst())
@@ -85,4 +88,63 @@ func TestIsTheSame(t *testing.T) {
 
 	c1, c2 = NewConfig(11), NewConfig(10)
 	assert.Equal(t, false, c1.IsTheSame(c2))
+
+	c1, c2 = NewConfig(10), NewConfig(10).WithAlgorithm(LeakyBucket)
+	assert.Equal(t, false, c1.IsTheSame(c2))
+}
+
+func TestNewConfigBurst(t *testing.T) {
+	c := NewConfig(0.5)
+	assert.Equal(t, 1, c.burst, "burst must be at least 1 byte")
+	require.NoError(t, c.Validate())
+
+	c = NewConfig(rate.Limit(math.MaxFloat64))
+	assert.Equal(t, math.MaxInt, c.burst)
+}
+
+func TestNewStrictConfig(t *testing.T) {
+	tests := map[string]struct {
+		limit rate.Limit
+		burst int
+		want  Config
+	}{
+		"default burst":         {limit: 20, want: Config{limit: 20, burst: 20}},
+		"default burst below 1": {limit: 0.5, want: Config{limit: 0.5, burst: 1}},
+		"burst":                 {limit: 20, burst: 5, want: Config{limit: 20, burst: 5}},
+		"unlimited":             {limit: rate.Inf, want: NewUnlimitedConfig()},
+	}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			c, err := NewStrictConfig(test.limit, test.burst)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, c)
+		})
+	}
+
+	invalid := map[string]struct {
+		limit rate.Limit
+		burst int
+	}{
+		"negative limit":       {limit: -1},
+		"zero limit":           {limit: 0},
+		"NaN limit":            {limit: rate.Limit(math.NaN())},
+		"negative burst":       {limit: 10, burst: -1},
+		"unlimited with burst": {limit: rate.Inf, burst: 10},
+	}
+	for testName, test := range invalid {
+		t.Run(testName, func(t *testing.T) {
+			_, err := NewStrictConfig(test.limit, test.burst)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, NewConfig(10).Validate())
+	require.NoError(t, NewUnlimitedConfig().Validate())
+	require.NoError(t, NewConfig(10).WithAlgorithm(SlidingWindow).Validate())
+
+	require.Error(t, Config{}.Validate(), "zero config must be invalid")
+	require.Error(t, Config{limit: 10}.Validate())
+	require.Error(t, NewConfig(10).WithAlgorithm(Algorithm(10)).Validate())
 }
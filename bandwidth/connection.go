@@ -2,87 +2,398 @@ package bandwidth
 
 import (
 	"context"
+	"errors"
 	"net"
 	"sync"
-
-	"golang.org/x/time/rate"
+	"time"
 )
 
 // globalLimitController is an internal interface which allows for connection
 // to get access to listener's data.
 // So the whole object listener does not have to be provided to connection.
 type globalLimitController interface {
-	// GetConnCfg returns current connection config.
+	// GetConnCfg returns current connection config for each direction.
 	// It returns also a channel which will be closed when config is changed again.
-	GetConnCfg() (<-chan struct{}, config)
-	// WaitN waits until global limiter allows for operating on n bytes.
-	WaitN(ctx context.Context, n int) (err error)
+	GetConnCfg() (<-chan struct{}, [directions]Config)
+}
+
+// Conn is a connection accepted by bandwidth listener.
+// Connection limits can be overridden per connection, e.g. after a client is authenticated.
+// Connection without overridden limits uses listener's connection limits.
+type Conn interface {
+	net.Conn
+	// SetLimit overrides connection limits for reading and writing.
+	SetLimit(cfg Config)
+	// SetReadLimit overrides connection limit for reading.
+	SetReadLimit(cfg Config)
+	// SetWriteLimit overrides connection limit for writing.
+	SetWriteLimit(cfg Config)
+	// ResetLimits removes overridden limits, so listener's connection limits are used again.
+	ResetLimits()
+	// Limits returns current connection limits for reading and writing.
+	Limits() (readCfg Config, writeCfg Config)
+	// SetPriority sets weight and priority of the connection in sharing global limit.
+	// It has effect only when the listener shares global limit fairly, see WithFairSharing.
+	SetPriority(weight, priority int)
+	// Priority returns weight and priority of the connection in sharing global limit.
+	Priority() (weight, priority int)
+	// Stats returns a snapshot of traffic statistics of the connection.
+	Stats() Stats
+	// ID returns an identifier of the connection, which is unique in its listener.
+	ID() uint64
 }
 
 type connection struct {
 	net.Conn
-	ctx        context.Context
-	mutex      sync.Mutex
-	limiter    *rate.Limiter
+	// id identifies the connection in its listener.
+	id uint64
+	// acceptedAt is a time when the connection was accepted.
+	acceptedAt time.Time
+	// ctx is canceled when the connection is closed, so all goroutines waiting for limiters are interrupted.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	mutex  sync.Mutex
+	// limiter is a connection rate limiter per direction, so reads and writes do not block each other.
+	limiter [directions]Limiter
+	// sharedLimiters are limiters shared with other connections per direction, e.g. source or global limiter.
+	// They are checked after connection limiter in the given order.
+	sharedLimiters [directions][]limiter
+	// flows are flows of the connection in fair schedulers of global limiter per direction.
+	// They are nil when global limit is not shared fairly.
+	flows      [directions]*fairFlow
 	controller globalLimitController
+	// clock tells the time while waiting for limiters.
+	clock Clock
+	// class is a name of a traffic class of the connection. It is empty when the connection does not have class.
+	class string
+	// quota counts bytes of the connection and other connections with the same key.
+	// It is nil when the connection does not have a quota.
+	quota *quotaCounter
+	// releases are called once when the connection is closed, so shared resources can be released.
+	releases  []func()
+	closeOnce sync.Once
+	// deadlines are read and write deadlines of the connection, which are respected while waiting for limiters.
+	deadlines [directions]deadline
 	// c is closed when configuration is changed, so current connection can read new config immediately.
 	c <-chan struct{}
+	// override is a connection limit per direction which is used instead of listener's connection limit.
+	// It is nil when it is not set.
+	override [directions]*Config
+	// observer is notified about throttling, exhausted quota and closing of the connection.
+	observer Observer
+	// stats counts traffic of the connection per direction. They are added to listener's statistics too.
+	stats [directions]trafficStats
 }
 
 // Write writes bytes into connection with respect to global and connection limiter.
+// Bytes are written in chunks which do not exceed limiters' bursts, so any size of a buffer can be used.
 func (bc *connection) Write(b []byte) (int, error) {
-	if err := bc.waitN(b); err != nil {
-		return 0, err
+	if len(b) == 0 {
+		return bc.Conn.Write(b)
+	}
+
+	written := 0
+	for written < len(b) {
+		reserved, rs, err := bc.waitN(writeDirection, len(b)-written)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := bc.Conn.Write(b[written : written+reserved])
+		// Bytes which have not been written, because of an error or a short write, are returned to limiters.
+		rs.ReturnN(reserved - n)
+		bc.stats[writeDirection].addBytes(bc.clock.Now(), n)
+		written += n
+		if err != nil {
+			return written, err
+		}
 	}
 
-	return bc.Conn.Write(b)
+	return written, nil
 }
 
 // Read reads bytes from a connection with respect to global and connection limiter.
+// Size of the read is clamped to limiters' bursts, so any size of a buffer can be used.
+// Limiters are charged only for bytes which have been really read.
 func (bc *connection) Read(b []byte) (int, error) {
-	if err := bc.waitN(b); err != nil {
+	reserved, rs, err := bc.waitN(readDirection, len(b))
+	if err != nil {
 		return 0, err
 	}
 
-	return bc.Conn.Read(b)
+	n, err := bc.Conn.Read(b[:reserved])
+	// Read often returns fewer bytes than requested or fails, so unused bytes are returned to limiters.
+	rs.ReturnN(reserved - n)
+	bc.stats[readDirection].addBytes(bc.clock.Now(), n)
+
+	return n, err
+}
+
+// Close closes the connection.
+// All goroutines which wait for limiters are interrupted and get net.ErrClosed.
+func (bc *connection) Close() error {
+	bc.cancel(net.ErrClosed)
+	bc.closeOnce.Do(func() {
+		for _, release := range bc.releases {
+			release()
+		}
+		bc.observer.OnClose(bc)
+	})
+
+	return bc.Conn.Close()
 }
 
-func (bc *connection) waitN(b []byte) error {
+// SetDeadline sets read and write deadlines of the connection.
+// Deadlines are respected also while waiting for limiters.
+func (bc *connection) SetDeadline(t time.Time) error {
+	if err := bc.Conn.SetDeadline(t); err != nil {
+		return err
+	}
+
+	for _, d := range bothDirections {
+		bc.deadlines[d].Set(t)
+	}
+
+	return nil
+}
+
+// SetReadDeadline sets read deadline of the connection.
+// Deadline is respected also while waiting for limiters.
+func (bc *connection) SetReadDeadline(t time.Time) error {
+	if err := bc.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	bc.deadlines[readDirection].Set(t)
+
+	return nil
+}
+
+// SetWriteDeadline sets write deadline of the connection.
+// Deadline is respected also while waiting for limiters.
+func (bc *connection) SetWriteDeadline(t time.Time) error {
+	if err := bc.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+
+	bc.deadlines[writeDirection].Set(t)
+
+	return nil
+}
+
+// waitN waits until connection and shared limiters allow for operating on bytes in a given direction.
+// It returns how many bytes are allowed, which is never greater than n,
+// and reservations which can be used to return unused bytes.
+func (bc *connection) waitN(d direction, n int) (int, reservations, error) {
 	select {
-	case <-bc.c:
+	case <-bc.configChanged():
 		// This channel can be only closed, so there is no need to check if something was populated into it.
 		bc.setLimiter()
 	default:
 		// Configuration per connection has not been changed.
 	}
 
-	// First of all wait for connection limiter permission.
-	// If it is not fulfilled then global limiter should not be blocked.
-	if err := bc.limiter.WaitN(bc.ctx, len(b)); err != nil {
-		return err
+	limiters := append([]limiter{waitingLimiter{bc.limiter[d]}}, bc.sharedLimiters[d]...)
+	rs := make(reservations, 0, len(limiters)+2)
+	if bc.quota != nil {
+		// Quota is reserved first, because it can reduce number of bytes or add a fallback limiter.
+		now := bc.clock.Now()
+		r, fallback, err := bc.quota.ReserveN(now, d, n)
+		if (errors.Is(err, ErrQuotaExceeded) || fallback != nil) && bc.quota.markExceeded(now) {
+			bc.observer.OnQuotaExceeded(bc, bc.quota.key)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		n = r.tokens
+		rs = append(rs, r)
+		if fallback != nil {
+			limiters = append(limiters, waitingLimiter{fallback})
+		}
 	}
 
-	// Now connection is ready to read bytes, so global limiter must be checked.
-	if err := bc.controller.WaitN(bc.ctx, len(b)); err != nil {
-		return err
+	bursts := make([]int, 0, len(limiters))
+	for _, limiter := range limiters {
+		bursts = append(bursts, limiter.Burst())
 	}
+	clamped := clampToBurst(n, bursts...)
+	rs.ReturnN(n - clamped)
+	n = clamped
 
-	return nil
+	start := bc.clock.Now()
+	waited := false
+	// Limiters are checked one by one starting from connection limiter.
+	// If one of them is not fulfilled then next limiters, which are shared with other connections, should not be blocked.
+	// When any of them fails then bytes reserved in previous limiters must be returned, because they are not used.
+	for _, limiter := range limiters {
+		r, err := limiter.waitN(bc.ctx, bc.clock, &bc.deadlines[d], n)
+		if err != nil {
+			rs.Cancel()
+			return 0, nil, err
+		}
+
+		if r.tokens < n {
+			// Limiter has allowed fewer bytes, e.g. its burst has been lowered while waiting,
+			// so previous limiters get the rest back.
+			rs.ReturnN(n - r.tokens)
+			n = r.tokens
+		}
+		rs = append(rs, r)
+		waited = waited || r.waited
+	}
+	if waited {
+		wait := bc.clock.Now().Sub(start)
+		bc.stats[d].addWait(wait)
+		bc.observer.OnThrottle(bc, n, wait)
+	}
+
+	return n, rs, nil
+}
+
+// clampToBurst returns n which does not exceed any of given bursts.
+// Rate limiter returns an error immediately when it is asked for more bytes than its burst.
+func clampToBurst(n int, bursts ...int) int {
+	if n <= 0 {
+		return n
+	}
+
+	for _, burst := range bursts {
+		n = min(n, burst)
+	}
+
+	// At least one byte must be requested, so the rate limiter with zero burst returns an error
+	// instead of looping forever.
+	return max(n, 1)
+}
+
+// configChanged returns channel which is closed when listener's connection config is changed.
+func (bc *connection) configChanged() <-chan struct{} {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	return bc.c
 }
 
 func (bc *connection) setLimiter() {
-	c, newCfg := bc.controller.GetConnCfg()
+	c, connCfg := bc.controller.GetConnCfg()
 
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
 
+	bc.applyConfig(c, connCfg)
+}
+
+// applyConfig sets limiters according to listener's connection config and overridden limits.
+// It requires that mutex is held.
+func (bc *connection) applyConfig(c <-chan struct{}, connCfg [directions]Config) {
 	bc.c = c
-	if newCfg.limit == bc.limiter.Limit() && newCfg.burst == bc.limiter.Burst() {
-		// It may happen that Read and Write compete with each other,
-		// so maybe one of them already changed it.
-		return
+	now := bc.clock.Now()
+	for _, d := range bothDirections {
+		newCfg := connCfg[d]
+		if bc.override[d] != nil {
+			// Overridden limit is not affected by listener's connection config.
+			newCfg = *bc.override[d]
+		}
+
+		limiter := bc.limiter[d]
+		if limiterConfig(limiter).IsTheSame(newCfg) {
+			// It may happen that Read and Write compete with each other,
+			// so maybe one of them already changed it.
+			continue
+		}
+
+		setLimiterConfig(limiter, now, newCfg)
 	}
+}
+
+// SetLimit overrides connection limits for reading and writing.
+func (bc *connection) SetLimit(cfg Config) {
+	bc.setOverride(&cfg, bothDirections...)
+}
+
+// SetReadLimit overrides connection limit for reading.
+func (bc *connection) SetReadLimit(cfg Config) {
+	bc.setOverride(&cfg, readDirection)
+}
+
+// SetWriteLimit overrides connection limit for writing.
+func (bc *connection) SetWriteLimit(cfg Config) {
+	bc.setOverride(&cfg, writeDirection)
+}
+
+// ResetLimits removes overridden limits, so listener's connection limits are used again.
+func (bc *connection) ResetLimits() {
+	bc.setOverride(nil, bothDirections...)
+}
+
+// Limits returns current connection limits for reading and writing.
+func (bc *connection) Limits() (Config, Config) {
+	return limiterConfig(bc.limiter[readDirection]), limiterConfig(bc.limiter[writeDirection])
+}
 
-	bc.limiter.SetLimit(newCfg.limit)
-	bc.limiter.SetBurst(newCfg.burst)
+// setOverride sets overridden limit for given directions.
+// When cfg is nil then listener's connection limit is restored.
+func (bc *connection) setOverride(cfg *Config, dirs ...direction) {
+	c, connCfg := bc.controller.GetConnCfg()
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for _, d := range dirs {
+		bc.override[d] = cfg
+	}
+	bc.applyConfig(c, connCfg)
+}
+
+// SetPriority sets weight and priority of the connection in sharing global limit.
+// Weight is a share of global limit among connections with the same priority, and weights lower than 1 are treated as 1.
+// Connections with a higher priority are always served before connections with a lower priority.
+func (bc *connection) SetPriority(weight, priority int) {
+	for _, d := range bothDirections {
+		if bc.flows[d] != nil {
+			bc.flows[d].SetPriority(weight, priority)
+		}
+	}
+}
+
+// Priority returns weight and priority of the connection in sharing global limit.
+func (bc *connection) Priority() (int, int) {
+	for _, d := range bothDirections {
+		if bc.flows[d] != nil {
+			return bc.flows[d].Priority()
+		}
+	}
+
+	return 1, 0
+}
+
+// Stats returns a snapshot of traffic statistics of the connection.
+func (bc *connection) Stats() Stats {
+	now := bc.clock.Now()
+
+	return Stats{
+		Read:  bc.stats[readDirection].Snapshot(now),
+		Write: bc.stats[writeDirection].Snapshot(now),
+	}
+}
+
+// ID returns an identifier of the connection, which is unique in its listener.
+func (bc *connection) ID() uint64 {
+	return bc.id
+}
+
+// info returns a description of the connection.
+func (bc *connection) info() ConnInfo {
+	readCfg, writeCfg := bc.Limits()
+
+	return ConnInfo{
+		ID:         bc.id,
+		RemoteAddr: bc.RemoteAddr(),
+		AcceptedAt: bc.acceptedAt,
+		Class:      bc.class,
+		ReadLimit:  readCfg,
+		WriteLimit: writeCfg,
+		Stats:      bc.Stats(),
+	}
 }
@@ -0,0 +1,46 @@
+package bandwidth
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline keeps a deadline for one direction of a connection.
+// Zero value is a deadline which is not set.
+type deadline struct {
+	mutex sync.Mutex
+	t     time.Time
+	// c is closed when deadline is changed, so goroutines waiting for limiters can check new deadline.
+	c chan struct{}
+}
+
+// Get returns current deadline.
+// It also returns channel, which will be closed when deadline is changed.
+// Zero time means that deadline is not set.
+func (dl *deadline) Get() (time.Time, <-chan struct{}) {
+	if dl == nil {
+		return time.Time{}, nil
+	}
+
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+
+	if dl.c == nil {
+		dl.c = make(chan struct{})
+	}
+
+	return dl.t, dl.c
+}
+
+// Set sets new deadline and informs all waiting goroutines about it.
+// Zero time means that deadline is not set.
+func (dl *deadline) Set(t time.Time) {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+
+	dl.t = t
+	if dl.c != nil {
+		close(dl.c)
+		dl.c = nil
+	}
+}
@@ -0,0 +1,28 @@
+package bandwidth
+
+// direction describes a flow of bytes in a connection.
+type direction int
+
+const (
+	// readDirection is used for bytes retrieved from a connection (ingress).
+	readDirection direction = iota
+	// writeDirection is used for bytes sent into a connection (egress).
+	writeDirection
+	// directions is a number of all directions, so it can be used as a size of arrays.
+	directions
+)
+
+// bothDirections contains all directions.
+var bothDirections = []direction{readDirection, writeDirection}
+
+// String returns name of the direction.
+func (d direction) String() string {
+	switch d {
+	case readDirection:
+		return "read"
+	case writeDirection:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
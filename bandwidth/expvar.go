@@ -0,0 +1,88 @@
+package bandwidth
+
+import (
+	"expvar"
+
+	"golang.org/x/time/rate"
+)
+
+// expvarState is listener's state published by expvar.
+type expvarState struct {
+	Global   expvarLimits  `json:"global"`
+	Conn     expvarLimits  `json:"conn"`
+	Accepted int64         `json:"accepted"`
+	Active   int64         `json:"active"`
+	Read     expvarTraffic `json:"read"`
+	Write    expvarTraffic `json:"write"`
+}
+
+// expvarLimits are limits for reading and writing.
+type expvarLimits struct {
+	Read  expvarConfig `json:"read"`
+	Write expvarConfig `json:"write"`
+}
+
+// expvarConfig is a limit config. Limit is nil and burst is zero when it is unlimited, because JSON does not have infinity.
+type expvarConfig struct {
+	Limit *float64 `json:"limit"`
+	Burst int      `json:"burst"`
+}
+
+// expvarTraffic are totals of traffic in one direction. Times are in seconds.
+type expvarTraffic struct {
+	Bytes    int64   `json:"bytes"`
+	Waits    int64   `json:"waits"`
+	WaitTime float64 `json:"waitSeconds"`
+	MaxWait  float64 `json:"maxWaitSeconds"`
+	Rate     float64 `json:"rate"`
+}
+
+// Expvar returns an expvar.Var which shows current global and connection limits,
+// numbers of accepted and active connections, and totals of traffic as JSON, e.g.:
+//
+//	{"global": {"read": {"limit": 1000000, "burst": 1000000}, "write": {"limit": null, "burst": 0}}, ...,
+//	 "accepted": 10, "active": 2, "read": {"bytes": 2048, "waits": 1, "waitSeconds": 0.5, ...}, ...}
+//
+// Unlimited limits are null with zero bursts. Use PublishExpvar to publish it under a given name.
+func (bl *listener) Expvar() expvar.Var {
+	return expvar.Func(func() any {
+		globalRead, connRead := bl.GetReadLimits()
+		globalWrite, connWrite := bl.GetWriteLimits()
+		stats := bl.Stats()
+
+		return expvarState{
+			Global:   expvarLimits{Read: newExpvarConfig(globalRead), Write: newExpvarConfig(globalWrite)},
+			Conn:     expvarLimits{Read: newExpvarConfig(connRead), Write: newExpvarConfig(connWrite)},
+			Accepted: stats.Accepted,
+			Active:   stats.Active,
+			Read:     newExpvarTraffic(stats.Read),
+			Write:    newExpvarTraffic(stats.Write),
+		}
+	})
+}
+
+// PublishExpvar publishes listener's state by expvar under a given name, so it is served at /debug/vars.
+// Like expvar.Publish, it panics when the name is already used.
+func (bl *listener) PublishExpvar(name string) {
+	expvar.Publish(name, bl.Expvar())
+}
+
+func newExpvarConfig(c Config) expvarConfig {
+	if c.limit == rate.Inf {
+		return expvarConfig{}
+	}
+
+	limit := float64(c.limit)
+
+	return expvarConfig{Limit: &limit, Burst: c.burst}
+}
+
+func newExpvarTraffic(s DirectionStats) expvarTraffic {
+	return expvarTraffic{
+		Bytes:    s.Bytes,
+		Waits:    s.Waits,
+		WaitTime: s.WaitTime.Seconds(),
+		MaxWait:  s.MaxWait.Seconds(),
+		Rate:     s.Rate,
+	}
+}
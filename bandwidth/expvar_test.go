@@ -0,0 +1,51 @@
+package bandwidth
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpvar(t *testing.T) {
+	clock := newTestClock()
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+	defer bl.Close()
+	bl.SetReadLimits(NewConfig(1000, 2000), NewConfig(10))
+	conn := acceptT(t, bl)
+	writeT(t, conn, newSlice(5))
+	closed := acceptT(t, bl)
+	require.NoError(t, closed.Close())
+
+	// Published names can not be reused, so the name is unique when the test is repeated.
+	name := fmt.Sprintf("bandwidth-test-%d", time.Now().UnixNano())
+	bl.PublishExpvar(name)
+	v := expvar.Get(name)
+	require.NotNil(t, v)
+	assert.Panics(t, func() {
+		bl.PublishExpvar(name)
+	})
+
+	var state map[string]any
+	require.NoError(t, json.Unmarshal([]byte(v.String()), &state))
+	expected := map[string]any{
+		"global": map[string]any{
+			"read":  map[string]any{"limit": 1000.0, "burst": 2000.0},
+			"write": map[string]any{"limit": nil, "burst": 0.0},
+		},
+		"conn": map[string]any{
+			"read":  map[string]any{"limit": 10.0, "burst": 10.0},
+			"write": map[string]any{"limit": nil, "burst": 0.0},
+		},
+		"accepted": 2.0,
+		"active":   1.0,
+		"read":     map[string]any{"bytes": 0.0, "waits": 0.0, "waitSeconds": 0.0, "maxWaitSeconds": 0.0, "rate": 0.0},
+		"write":    map[string]any{"bytes": 5.0, "waits": 0.0, "waitSeconds": 0.0, "maxWaitSeconds": 0.0, "rate": 1.0},
+	}
+	assert.Equal(t, expected, state)
+}
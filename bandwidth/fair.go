@@ -0,0 +1,328 @@
+package bandwidth
+
+import (
+	"container/heap"
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// fairScheduler shares a limiter fairly among connections which are waiting for it.
+// Without it, the limiter serves reservations in order of their arrival, so a connection
+// with larger buffers or more goroutines gets more bytes than others.
+//
+// Each connection is a flow. Waiting requests get virtual finish times (self-clocked fair queuing),
+// and they are granted in order of these times, which is a round-robin counted in bytes:
+// when connections are contended, each of them gets the same number of bytes regardless of sizes of its reads and writes.
+// Connection which does not use its share leaves it to others, and it does not collect credit while idle.
+//
+// Flows can have weights, so a flow with weight 4 gets four times more bytes than a flow with weight 1,
+// and priorities, so flows with a higher priority are always served before flows with a lower priority.
+// Flows with the same priority share the rest proportionally to their weights (weighted fair queuing).
+type fairScheduler struct {
+	mutex   sync.Mutex
+	limiter Limiter
+	// clock is used by the dispatcher to wait for bytes.
+	clock Clock
+	// queue keeps waiting requests of all flows ordered by virtual finish times.
+	queue fairQueue
+	// virtualTime is a virtual finish time of the last granted request per priority.
+	virtualTime map[int]float64
+	// seq is a sequence number of the last queued request. It keeps FIFO order of requests with the same finish time.
+	seq uint64
+	// dispatching is true when a goroutine grants waiting requests.
+	dispatching bool
+}
+
+// fairFlow is a limiter of one connection in a fair scheduler.
+type fairFlow struct {
+	scheduler *fairScheduler
+	// finish is a virtual finish time of the last queued request of the flow.
+	finish float64
+	// weight is a share of the flow among flows with the same priority.
+	weight int
+	// priority is a strict priority of the flow. Higher priority is served first.
+	priority int
+}
+
+// Prioritizer returns a weight and a priority for an accepted connection,
+// e.g. weight 4 for API traffic and weight 1 for bulk downloads.
+// Weight is a share of global limit among connections with the same priority, and weights lower than 1 are treated as 1.
+// Connections with a higher priority are always served before connections with a lower priority.
+// Default weight is 1 and default priority is 0.
+type Prioritizer func(conn net.Conn) (weight, priority int)
+
+// fairRequest is a request for bytes which waits for its turn.
+type fairRequest struct {
+	flow *fairFlow
+	n    int
+	// finish is a virtual time when the request is completed.
+	finish float64
+	// cost is a virtual time which the request takes.
+	cost     float64
+	priority int
+	seq      uint64
+	// index is a position of the request in the queue. It is -1 when the request is not queued.
+	index int
+	// granted receives the result when it is the request's turn.
+	// It is buffered, so the dispatcher does not wait for the requester.
+	granted chan fairGrant
+}
+
+// fairGrant is a result of a granted request.
+type fairGrant struct {
+	r   *Reservation
+	err error
+}
+
+func newFairScheduler(clock Clock, limiter Limiter) *fairScheduler {
+	return &fairScheduler{
+		limiter:     limiter,
+		clock:       clock,
+		virtualTime: make(map[int]float64),
+	}
+}
+
+// Flow returns a new flow of the scheduler with default weight and priority, which should be used by one connection.
+func (s *fairScheduler) Flow() *fairFlow {
+	return &fairFlow{scheduler: s, weight: 1}
+}
+
+// SetPriority sets weight and priority of the flow. Requests which are already waiting are not affected.
+func (f *fairFlow) SetPriority(weight, priority int) {
+	f.scheduler.mutex.Lock()
+	defer f.scheduler.mutex.Unlock()
+
+	if priority != f.priority {
+		// Virtual times of different priorities are not comparable.
+		f.finish = 0
+	}
+	f.weight = max(weight, 1)
+	f.priority = priority
+}
+
+// Priority returns weight and priority of the flow.
+func (f *fairFlow) Priority() (weight, priority int) {
+	f.scheduler.mutex.Lock()
+	defer f.scheduler.mutex.Unlock()
+
+	return f.weight, f.priority
+}
+
+// Burst returns the burst of the scheduler's limiter.
+func (f *fairFlow) Burst() int {
+	return f.scheduler.limiter.Burst()
+}
+
+// waitN waits for the flow's turn, reserves n bytes in the limiter, and waits until they can be used.
+// When nobody else is waiting, and the limiter has enough bytes, then bytes are reserved immediately.
+// Fewer bytes are reserved when the burst is lowered while the flow waits, see Reservation.tokens.
+func (f *fairFlow) waitN(ctx context.Context, clock Clock, dl *deadline, n int) (*Reservation, error) {
+	s := f.scheduler
+
+	s.mutex.Lock()
+	now := clock.Now()
+	if s.queue.Len() == 0 && limiterDelay(s.limiter, now, n) == 0 {
+		r, err := s.limiter.ReserveN(now, n)
+		s.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		return waitGranted(ctx, clock, dl, r)
+	}
+
+	req := s.enqueue(f, n)
+	s.mutex.Unlock()
+
+	g, err := req.waitForTurn(ctx, clock, dl)
+	if err != nil {
+		if s.abandon(req) {
+			return nil, err
+		}
+
+		// The request has been granted in the meantime, so its bytes must be returned.
+		if g = <-req.granted; g.r != nil {
+			g.r.Cancel()
+		}
+
+		return nil, err
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	// The flow has waited in the queue.
+	g.r.waited = true
+
+	return waitGranted(ctx, clock, dl, g.r)
+}
+
+// waitGranted waits until granted bytes can be used. They are returned when waiting fails.
+func waitGranted(ctx context.Context, clock Clock, dl *deadline, r *Reservation) (*Reservation, error) {
+	if err := r.wait(ctx, clock, dl); err != nil {
+		r.Cancel()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// enqueue adds a request of a flow to the queue and makes sure that it will be granted.
+// It requires that mutex is held.
+func (s *fairScheduler) enqueue(f *fairFlow, n int) *fairRequest {
+	// Idle flow starts from the current virtual time, so it does not get credit for the time it has not used.
+	// Flow with a higher weight moves slower in virtual time, so it is served more often.
+	cost := float64(n) / float64(f.weight)
+	f.finish = max(f.finish, s.virtualTime[f.priority]) + cost
+	s.seq++
+	req := &fairRequest{
+		flow:     f,
+		n:        n,
+		finish:   f.finish,
+		cost:     cost,
+		priority: f.priority,
+		seq:      s.seq,
+		granted:  make(chan fairGrant, 1),
+	}
+	heap.Push(&s.queue, req)
+
+	if !s.dispatching {
+		s.dispatching = true
+		go s.dispatch()
+	}
+
+	return req
+}
+
+// abandon removes a request which does not wait anymore.
+// It returns false when the request has been already granted.
+func (s *fairScheduler) abandon(req *fairRequest) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if req.index < 0 {
+		return false
+	}
+
+	heap.Remove(&s.queue, req.index)
+	if req.flow.finish == req.finish {
+		// It is the last request of the flow, so the flow is not charged for it.
+		req.flow.finish -= req.cost
+	}
+
+	return true
+}
+
+// dispatch grants waiting requests one by one until the queue is empty.
+// Request is granted when the limiter has enough bytes for it, so granted connection can use them immediately.
+// The next request is chosen just before it is granted, so connections which have just used their bytes
+// can queue again, and they are not overtaken by connections which have been waiting longer.
+func (s *fairScheduler) dispatch() {
+	for {
+		s.mutex.Lock()
+		if s.queue.Len() == 0 {
+			s.dispatching = false
+			s.mutex.Unlock()
+			return
+		}
+
+		now := s.clock.Now()
+		// Burst can be lowered while the request waits, so it is granted at most the current burst.
+		n := clampToBurst(s.queue[0].n, s.limiter.Burst())
+		if delay := limiterDelay(s.limiter, now, n); delay > 0 {
+			s.mutex.Unlock()
+			timer := s.clock.NewTimer(delay)
+			<-timer.C()
+			continue
+		}
+
+		req := s.next()
+		r, err := s.limiter.ReserveN(now, n)
+		req.granted <- fairGrant{r: r, err: err}
+		s.mutex.Unlock()
+	}
+}
+
+// next removes the request with the highest priority and the earliest virtual finish time from the queue.
+// It requires that mutex is held, and the queue is not empty.
+func (s *fairScheduler) next() *fairRequest {
+	req := heap.Pop(&s.queue).(*fairRequest)
+	s.virtualTime[req.priority] = req.finish
+
+	return req
+}
+
+// waitForTurn waits until the request is granted, the context is done, or the deadline is exceeded.
+func (req *fairRequest) waitForTurn(ctx context.Context, clock Clock, dl *deadline) (fairGrant, error) {
+	for {
+		t, deadlineChanged := dl.Get()
+		var expired <-chan time.Time
+		var timer Timer
+		if !t.IsZero() {
+			timer = clock.NewTimer(t.Sub(clock.Now()))
+			expired = timer.C()
+		}
+		stop := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+
+		select {
+		case g := <-req.granted:
+			stop()
+			return g, nil
+		case <-deadlineChanged:
+			// New deadline must be checked.
+			stop()
+		case <-expired:
+			return fairGrant{}, os.ErrDeadlineExceeded
+		case <-ctx.Done():
+			stop()
+			return fairGrant{}, context.Cause(ctx)
+		}
+	}
+}
+
+// fairQueue is a priority queue of requests ordered by priorities and virtual finish times.
+// It implements heap.Interface.
+type fairQueue []*fairRequest
+
+func (q fairQueue) Len() int {
+	return len(q)
+}
+
+func (q fairQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	if q[i].finish != q[j].finish {
+		return q[i].finish < q[j].finish
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q fairQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *fairQueue) Push(x any) {
+	req := x.(*fairRequest)
+	req.index = len(*q)
+	*q = append(*q, req)
+}
+
+func (q *fairQueue) Pop() any {
+	old := *q
+	req := old[len(old)-1]
+	old[len(old)-1] = nil
+	req.index = -1
+	*q = old[:len(old)-1]
+
+	return req
+}
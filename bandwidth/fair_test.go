@@ -0,0 +1,196 @@
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newQueueingScheduler returns a fair scheduler which only queues requests, so their order can be checked.
+func newQueueingScheduler(cfg Config) *fairScheduler {
+	s := newFairScheduler(systemClock{}, newBucket(cfg))
+	s.dispatching = true
+
+	return s
+}
+
+func TestFairSchedulerOrder(t *testing.T) {
+	t.Run("requests are granted by bytes in round-robin", func(t *testing.T) {
+		s := newQueueingScheduler(NewConfig(10))
+		a, b, c := s.Flow(), s.Flow(), s.Flow()
+
+		a1 := s.enqueue(a, 10)
+		a2 := s.enqueue(a, 10)
+		b1 := s.enqueue(b, 10)
+		c1 := s.enqueue(c, 30)
+		b2 := s.enqueue(b, 5)
+
+		var got []*fairRequest
+		for s.queue.Len() > 0 {
+			got = append(got, s.next())
+		}
+		assert.Equal(t, []*fairRequest{a1, b1, b2, a2, c1}, got)
+	})
+
+	t.Run("idle flow does not collect credit", func(t *testing.T) {
+		s := newQueueingScheduler(NewConfig(10))
+		busy, idle := s.Flow(), s.Flow()
+
+		for i := 0; i < 10; i++ {
+			s.enqueue(busy, 10)
+			s.next()
+		}
+		busy1 := s.enqueue(busy, 10)
+		idle1 := s.enqueue(idle, 10)
+		busy2 := s.enqueue(busy, 10)
+		idle2 := s.enqueue(idle, 10)
+
+		assert.Same(t, busy1, s.next())
+		assert.Same(t, idle1, s.next())
+		assert.Same(t, busy2, s.next())
+		assert.Same(t, idle2, s.next())
+	})
+}
+
+func TestFairSchedulerPriority(t *testing.T) {
+	t.Run("requests are granted by weights", func(t *testing.T) {
+		s := newQueueingScheduler(NewConfig(10))
+		heavy, light := s.Flow(), s.Flow()
+		heavy.SetPriority(3, 0)
+
+		var heavyBytes, lightBytes int
+		for i := 0; i < 3; i++ {
+			s.enqueue(heavy, 10)
+			s.enqueue(light, 10)
+		}
+		for i := 0; i < 4; i++ {
+			req := s.next()
+			if req.flow == heavy {
+				heavyBytes += req.n
+			} else {
+				lightBytes += req.n
+			}
+		}
+		assert.Equal(t, 30, heavyBytes)
+		assert.Equal(t, 10, lightBytes)
+	})
+
+	t.Run("requests with higher priority are granted first", func(t *testing.T) {
+		s := newQueueingScheduler(NewConfig(10))
+		low, high := s.Flow(), s.Flow()
+		low.SetPriority(100, 0)
+		high.SetPriority(1, 1)
+
+		low1 := s.enqueue(low, 1)
+		high1 := s.enqueue(high, 10)
+		high2 := s.enqueue(high, 10)
+		assert.Same(t, high1, s.next())
+		assert.Same(t, high2, s.next())
+		assert.Same(t, low1, s.next())
+	})
+
+	t.Run("weight lower than 1 is treated as 1", func(t *testing.T) {
+		s := newQueueingScheduler(NewConfig(10))
+		f := s.Flow()
+		f.SetPriority(-2, 3)
+		weight, priority := f.Priority()
+		assert.Equal(t, 1, weight)
+		assert.Equal(t, 3, priority)
+	})
+}
+
+func TestFairSchedulerAbandon(t *testing.T) {
+	s := newQueueingScheduler(NewConfig(10))
+	a, b := s.Flow(), s.Flow()
+
+	a1 := s.enqueue(a, 10)
+	b1 := s.enqueue(b, 10)
+	a2 := s.enqueue(a, 10)
+	require.True(t, s.abandon(a2))
+	assert.Equal(t, 2, s.queue.Len())
+	assert.InDelta(t, 10, a.finish, 0.1, "flow must not be charged for abandoned request")
+
+	require.Same(t, a1, s.next())
+	assert.False(t, s.abandon(a1), "granted request can not be abandoned")
+	assert.Same(t, b1, s.next())
+}
+
+func TestFairFlowWaitN(t *testing.T) {
+	t.Run("bytes are reserved immediately when nobody waits", func(t *testing.T) {
+		s := newFairScheduler(systemClock{}, newBucket(NewConfig(10)))
+		r, err := s.Flow().waitN(context.Background(), systemClock{}, nil, 10)
+		require.NoError(t, err)
+		assert.Equal(t, 10, r.tokens)
+		assert.False(t, s.dispatching)
+	})
+
+	t.Run("waiting requests are granted", func(t *testing.T) {
+		s := newFairScheduler(systemClock{}, newBucket(NewConfig(100, 10)))
+		a, b := s.Flow(), s.Flow()
+		_, err := a.waitN(context.Background(), systemClock{}, nil, 10)
+		require.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := a.waitN(context.Background(), systemClock{}, nil, 10)
+			assert.NoError(t, err)
+		}()
+		_, err = b.waitN(context.Background(), systemClock{}, nil, 10)
+		require.NoError(t, err)
+		<-done
+	})
+
+	t.Run("waiting is interrupted", func(t *testing.T) {
+		s := newFairScheduler(systemClock{}, newBucket(NewConfig(1, 10)))
+		f := s.Flow()
+		_, err := f.waitN(context.Background(), systemClock{}, nil, 10)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(net.ErrClosed)
+		_, err = f.waitN(ctx, systemClock{}, nil, 10)
+		assert.ErrorIs(t, err, net.ErrClosed)
+
+		dl := &deadline{}
+		dl.Set(time.Now().Add(50 * time.Millisecond))
+		_, err = f.waitN(context.Background(), systemClock{}, dl, 10)
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	})
+
+	t.Run("waiting request is clamped to lowered burst", func(t *testing.T) {
+		clock := newTestClock()
+		s := newFairScheduler(clock, newBucket(NewConfig(100)))
+		f := s.Flow()
+		_, err := f.waitN(context.Background(), clock, nil, 100)
+		require.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r, err := f.waitN(context.Background(), clock, nil, 100)
+			assert.NoError(t, err)
+			assert.Equal(t, 10, r.tokens)
+		}()
+		clock.BlockUntil(1)
+		setLimiterConfig(s.limiter, clock.Now(), NewConfig(10))
+		clock.Advance(time.Second)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			require.FailNow(t, "request must be granted with the lowered burst")
+		}
+	})
+
+	t.Run("bytes exceed burst", func(t *testing.T) {
+		s := newFairScheduler(systemClock{}, newBucket(NewConfig(10)))
+		_, err := s.Flow().waitN(context.Background(), systemClock{}, nil, 11)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,152 @@
+package bandwidth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is a configuration of listener's limits, which can be loaded from a JSON or YAML file.
+// Limits are texts parsed by ParseConfig, e.g. "10MiB/s burst 1MiB", and missing limits are unlimited.
+// Each limit is used for both reading and writing.
+//
+// Example in YAML:
+//
+//	global: 100MB/s
+//	conn: 1MB/s
+//	classes:
+//	  internal:
+//	    limit: 50MB/s
+//	    conn: 10MB/s
+//	    bypassGlobal: true
+//	ips:
+//	  10.0.0.0/8:
+//	    conn: 20MB/s
+type FileConfig struct {
+	// Global is a limit shared by all connections.
+	Global Config `json:"global" yaml:"global"`
+	// Conn is a limit of each connection.
+	Conn Config `json:"conn" yaml:"conn"`
+	// Source is a limit shared by connections from the same source. It requires WithSourceLimits option.
+	Source Config `json:"source" yaml:"source"`
+	// Classes are limits of traffic classes by their names. They require WithClassifier option.
+	Classes map[string]ClassFileConfig `json:"classes" yaml:"classes"`
+	// IPs are limits of connections by IP addresses or subnets, e.g. "192.168.1.1" or "10.0.0.0/8".
+	IPs map[string]IPFileConfig `json:"ips" yaml:"ips"`
+}
+
+// ClassFileConfig is a configuration of a traffic class in FileConfig.
+type ClassFileConfig struct {
+	// Limit is a limit shared by all connections of the class.
+	Limit Config `json:"limit" yaml:"limit"`
+	// Conn is a limit of each connection of the class. When it is missing, then Conn of the listener is used.
+	Conn Config `json:"conn" yaml:"conn"`
+	// BypassGlobal is true when connections of the class are not limited by global limit.
+	BypassGlobal bool `json:"bypassGlobal" yaml:"bypassGlobal"`
+}
+
+// IPFileConfig is a configuration of an IP address or subnet in FileConfig.
+type IPFileConfig struct {
+	// Limit is a limit shared by all connections from the subnet.
+	Limit Config `json:"limit" yaml:"limit"`
+	// Conn is a limit of each connection from the subnet. When it is missing, then Conn of the class or the listener is used.
+	Conn Config `json:"conn" yaml:"conn"`
+}
+
+// LoadFileConfig loads a configuration from a JSON file with .json extension,
+// or from a YAML file with .yaml or .yml extension. Unknown fields are reported as errors.
+func LoadFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth: failed to read config: %w", err)
+	}
+
+	fc := &FileConfig{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(fc)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(fc)
+		if errors.Is(err, io.EOF) {
+			// Empty file means that everything is unlimited.
+			err = nil
+		}
+	default:
+		return nil, fmt.Errorf("bandwidth: unknown format of config %q", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth: failed to decode config from %q: %w", path, err)
+	}
+
+	if err := fc.Validate(); err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+// Validate returns an error when any limit or IP address is invalid. Missing limits are valid.
+func (fc *FileConfig) Validate() error {
+	var errs []error
+	check := func(name string, c Config) {
+		if err := orUnlimited(c).Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	check("global", fc.Global)
+	check("conn", fc.Conn)
+	check("source", fc.Source)
+	for name, cl := range fc.Classes {
+		check("class "+name, cl.Limit)
+		check("class "+name+" conn", cl.Conn)
+	}
+	for text, ip := range fc.IPs {
+		if _, err := parseIPPrefix(text); err != nil {
+			errs = append(errs, err)
+		}
+		check("ip "+text, ip.Limit)
+		check("ip "+text+" conn", ip.Conn)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ipPrefixes returns IP limits by their subnets. It requires that the config is valid.
+func (fc *FileConfig) ipPrefixes() map[netip.Prefix]IPFileConfig {
+	prefixes := make(map[netip.Prefix]IPFileConfig, len(fc.IPs))
+	for text, ip := range fc.IPs {
+		prefix, _ := parseIPPrefix(text)
+		prefixes[prefix] = ip
+	}
+
+	return prefixes
+}
+
+// parseIPPrefix returns a subnet for a text with a subnet, e.g. "10.0.0.0/8", or an IP address,
+// which is a subnet with all bits.
+func parseIPPrefix(text string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(text); err == nil {
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("bandwidth: invalid IP address or subnet %q", text)
+	}
+	addr = addr.Unmap().WithZone("")
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
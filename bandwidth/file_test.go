@@ -0,0 +1,99 @@
+package bandwidth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFileConfig(t *testing.T) {
+	want := &FileConfig{
+		Global: NewConfig(100000000),
+		Conn:   NewConfig(1000000, 100000),
+		Classes: map[string]ClassFileConfig{
+			"internal": {Limit: NewConfig(50000000), BypassGlobal: true},
+		},
+		IPs: map[string]IPFileConfig{
+			"10.0.0.0/8": {Conn: NewConfig(20 << 20).WithAlgorithm(LeakyBucket)},
+		},
+	}
+
+	files := map[string]string{
+		"limits.json": `{
+			"global": "100MB/s",
+			"conn": "1MB/s burst 100kB",
+			"classes": {"internal": {"limit": "50MB/s", "bypassGlobal": true}},
+			"ips": {"10.0.0.0/8": {"conn": "20MiB/s algorithm leaky-bucket"}}
+		}`,
+		"limits.yaml": `
+global: 100MB/s
+conn: 1MB/s burst 100kB
+classes:
+  internal:
+    limit: 50MB/s
+    bypassGlobal: true
+ips:
+  10.0.0.0/8:
+    conn: 20MiB/s algorithm leaky-bucket
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+			fc, err := LoadFileConfig(path)
+			require.NoError(t, err)
+			assert.Equal(t, want, fc)
+		})
+	}
+
+	t.Run("empty YAML file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "limits.yml")
+		require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+		fc, err := LoadFileConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, &FileConfig{}, fc)
+	})
+
+	invalid := map[string]string{
+		"limit.json":   `{"global": "fast"}`,
+		"unknown.json": `{"globl": "1MB/s"}`,
+		"unknown.yaml": `globl: 1MB/s`,
+		"ip.json":      `{"ips": {"10.0.0.300": {"conn": "1MB/s"}}}`,
+		"syntax.json":  `{"global": `,
+		"limits.toml":  `global = "1MB/s"`,
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+			_, err := LoadFileConfig(path)
+			require.Error(t, err)
+		})
+	}
+
+	_, err := LoadFileConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileConfigValidate(t *testing.T) {
+	require.NoError(t, (&FileConfig{}).Validate(), "missing limits must be unlimited")
+	require.NoError(t, (&FileConfig{IPs: map[string]IPFileConfig{"192.168.1.1": {}, "::1": {}}}).Validate())
+
+	fc := &FileConfig{
+		Conn:    Config{limit: 10},
+		Classes: map[string]ClassFileConfig{"a": {Limit: NewConfig(10).WithAlgorithm(Algorithm(10))}},
+		IPs:     map[string]IPFileConfig{"localhost": {}},
+	}
+	err := fc.Validate()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "conn")
+	assert.ErrorContains(t, err, "class a")
+	assert.ErrorContains(t, err, "localhost")
+}
@@ -0,0 +1,126 @@
+package bandwidth
+
+import (
+	"sync"
+)
+
+// limitGroup keeps a rate limiter shared by a group of connections, e.g. all connections
+// of a listener, and a limit config for each connection of the group.
+type limitGroup struct {
+	// clock tells the time when limits are changed.
+	clock Clock
+	// c is closed when configuration for connections is changed, so all existing connections can read new config.
+	c     chan struct{}
+	mutex sync.RWMutex
+	// limitCfgConn is current limit config for a connection per direction.
+	limitCfgConn [directions]Config
+	// limitCfgShared is a current limit of the whole group per direction.
+	limitCfgShared [directions]Config
+	// sharedLimiter is a rate limiter shared across all connections of the group per direction.
+	sharedLimiter [directions]Limiter
+	// onConnChange is called when connection config of the group is changed, so groups which inherit it
+	// can inform their connections. It can be nil.
+	onConnChange func()
+}
+
+// init sets unlimited shared limiter created by a given factory and a given connection config.
+// Zero connection config is missing, so it is inherited from the next group in a limitChain.
+func (g *limitGroup) init(clock Clock, newLimiter LimiterFactory, connCfg Config) {
+	unlimited := NewUnlimitedConfig()
+	g.clock = clock
+	g.c = make(chan struct{})
+	for _, d := range bothDirections {
+		g.limitCfgConn[d] = connCfg
+		g.limitCfgShared[d] = unlimited
+		g.sharedLimiter[d] = newLimiter(unlimited)
+	}
+}
+
+// GetConnCfg returns connection config for reading and writing.
+// It also returns channel, which will be closed when configuration is changed.
+func (g *limitGroup) GetConnCfg() (<-chan struct{}, [directions]Config) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.c, g.limitCfgConn
+}
+
+func (g *limitGroup) getLimits(d direction) (Config, Config) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.limitCfgShared[d], g.limitCfgConn[d]
+}
+
+// setLimits sets shared and connection configs in given directions. Zero shared config is unlimited,
+// and zero connection config is missing, so it is inherited from the next group in a limitChain.
+func (g *limitGroup) setLimits(sharedCfg, connCfg Config, dirs ...direction) {
+	if g.updateLimits(orUnlimited(sharedCfg), connCfg, dirs...) && g.onConnChange != nil {
+		g.onConnChange()
+	}
+}
+
+// updateLimits sets shared and connection configs in given directions.
+// It returns true when connection config has been changed.
+func (g *limitGroup) updateLimits(sharedCfg, connCfg Config, dirs ...direction) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.clock.Now()
+	connChanged := false
+	for _, d := range dirs {
+		g.limitCfgShared[d] = sharedCfg
+		setLimiterConfig(g.sharedLimiter[d], now, sharedCfg)
+
+		if !g.limitCfgConn[d].IsTheSame(connCfg) {
+			g.limitCfgConn[d] = connCfg
+			connChanged = true
+		}
+	}
+
+	if !connChanged {
+		// Nothing changes for connections.
+		return false
+	}
+
+	g.notify()
+
+	return true
+}
+
+// notify informs all existing connections about new configuration by closing channel.
+// Create a new channel which will be closed when config changes next time, so
+// connection will be informed once again. It requires that mutex is held.
+func (g *limitGroup) notify() {
+	close(g.c)
+	g.c = make(chan struct{})
+}
+
+// inheritedChanged informs connections of the group that connection config of a group, which it inherits from,
+// has been changed.
+func (g *limitGroup) inheritedChanged() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.notify()
+}
+
+// limitChain is a chain of limit groups of a connection from the most specific one, e.g. a subnet,
+// a traffic class and a listener. Missing connection config of a group is inherited from next groups.
+// Changes of next groups are passed on to the first group, so its channel is closed on changes of the whole chain.
+type limitChain []*limitGroup
+
+// GetConnCfg returns connection config for reading and writing, and a channel of the first group.
+func (lc limitChain) GetConnCfg() (<-chan struct{}, [directions]Config) {
+	c, connCfg := lc[0].GetConnCfg()
+	for _, g := range lc[1:] {
+		_, inherited := g.GetConnCfg()
+		for _, d := range bothDirections {
+			if connCfg[d] == (Config{}) {
+				connCfg[d] = inherited[d]
+			}
+		}
+	}
+
+	return c, connCfg
+}
@@ -0,0 +1,209 @@
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// htb is a hierarchical token bucket. It is a tree of nodes, where each node has a guaranteed (assured) rate
+// and a ceiling. Each node gets its guaranteed rate even when other nodes compete for their ancestors,
+// so guaranteed rates of children should not exceed the guaranteed rate of their parent.
+// Node which has used its guaranteed rate borrows idle capacity from its ancestors,
+// but it never exceeds its ceiling and ceilings of its ancestors.
+type htb struct {
+	// mutex protects structure of the tree, and it makes reservations in all nodes of a path atomic.
+	mutex sync.Mutex
+	nodes map[string]*htbNode
+	// clock tells the time when nodes are changed.
+	clock Clock
+	// newLimiter creates limiters of new nodes.
+	newLimiter LimiterFactory
+}
+
+// htbNode is a node of hierarchical token bucket.
+type htbNode struct {
+	parent *htbNode
+	// children is a number of nodes which have this node as a parent.
+	children int
+	// assured is a limiter with guaranteed rate per direction.
+	assured [directions]Limiter
+	// ceil is a limiter with the maximum rate per direction.
+	ceil [directions]Limiter
+}
+
+func newHTB() *htb {
+	return &htb{
+		nodes:      make(map[string]*htbNode),
+		clock:      systemClock{},
+		newLimiter: newBucketLimiter,
+	}
+}
+
+// Set adds or changes a node with a given name in given directions.
+// Empty parent means that the node is at the top of the tree.
+// New node is unlimited in directions which are not given.
+func (h *htb) Set(name, parent string, assured, ceil Config, dirs ...direction) error {
+	if name == "" {
+		return errors.New("bandwidth: name of HTB node must not be empty")
+	}
+	assured, ceil = orUnlimited(assured), orUnlimited(ceil)
+	if assured.limit > ceil.limit {
+		return fmt.Errorf("bandwidth: guaranteed rate %v of HTB node %q exceeds its ceiling %v",
+			assured.limit, name, ceil.limit)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var parentNode *htbNode
+	if parent != "" {
+		var ok bool
+		if parentNode, ok = h.nodes[parent]; !ok {
+			return fmt.Errorf("bandwidth: parent HTB node %q does not exist", parent)
+		}
+	}
+
+	node, ok := h.nodes[name]
+	if !ok {
+		node = &htbNode{}
+		unlimited := NewUnlimitedConfig()
+		for _, d := range bothDirections {
+			node.assured[d] = h.newLimiter(unlimited)
+			node.ceil[d] = h.newLimiter(unlimited)
+		}
+	}
+
+	for ancestor := parentNode; ancestor != nil; ancestor = ancestor.parent {
+		if ancestor == node {
+			return fmt.Errorf("bandwidth: HTB node %q can not be a descendant of itself", name)
+		}
+	}
+
+	if node.parent != nil {
+		node.parent.children--
+	}
+	if parentNode != nil {
+		parentNode.children++
+	}
+	node.parent = parentNode
+	h.nodes[name] = node
+
+	now := h.clock.Now()
+	for _, d := range dirs {
+		setLimiterConfig(node.assured[d], now, assured)
+		setLimiterConfig(node.ceil[d], now, ceil)
+	}
+
+	return nil
+}
+
+// Remove removes a node without children.
+// Connections attached to the node are not limited by the tree anymore.
+func (h *htb) Remove(name string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	node, ok := h.nodes[name]
+	if !ok {
+		return fmt.Errorf("bandwidth: HTB node %q does not exist", name)
+	}
+	if node.children > 0 {
+		return fmt.Errorf("bandwidth: HTB node %q has children", name)
+	}
+
+	if node.parent != nil {
+		node.parent.children--
+	}
+	delete(h.nodes, name)
+
+	return nil
+}
+
+// Limiter returns a limiter of a node with a given name for a given direction.
+// The node is looked up on each reservation, so it can be added, changed or removed at any time.
+func (h *htb) Limiter(name string, d direction) htbLimiter {
+	return htbLimiter{tree: h, name: name, d: d}
+}
+
+// htbLimiter is a limiter of a node in hierarchical token bucket.
+type htbLimiter struct {
+	tree *htb
+	name string
+	d    direction
+}
+
+// Burst returns the lowest burst of all nodes from the node to the top of the tree.
+func (l htbLimiter) Burst() int {
+	l.tree.mutex.Lock()
+	defer l.tree.mutex.Unlock()
+
+	burst := math.MaxInt
+	for node := l.tree.nodes[l.name]; node != nil; node = node.parent {
+		burst = min(burst, node.assured[l.d].Burst(), node.ceil[l.d].Burst())
+	}
+
+	return burst
+}
+
+// waitN reserves n bytes in all nodes from the node to the top of the tree, and waits until they can be used.
+func (l htbLimiter) waitN(ctx context.Context, clock Clock, dl *deadline, n int) (*Reservation, error) {
+	return reserveAndWait(ctx, clock, dl, l, n)
+}
+
+// ReserveN reserves n bytes in nodes from the node to the top of the tree.
+// Bytes are served by the lowest node which can provide them the earliest, which is the lender:
+// the node itself within its guaranteed rate, or an ancestor with idle guaranteed rate.
+// Bytes wait only for ceilings of nodes from the node up to the lender, so bytes within
+// the guaranteed rate are never delayed by other nodes which borrow from ancestors.
+// All ceilings are charged, and guaranteed rates are charged from the lender to the top of the tree,
+// so bytes used by a node within its guarantee are not lent to other nodes.
+func (l htbLimiter) ReserveN(now time.Time, n int) (*Reservation, error) {
+	l.tree.mutex.Lock()
+	defer l.tree.mutex.Unlock()
+
+	r := &Reservation{tokens: n, timeToAct: now}
+	var path []*htbNode
+	for node := l.tree.nodes[l.name]; node != nil; node = node.parent {
+		path = append(path, node)
+	}
+
+	lender, ceilDelay, lenderDelay := 0, time.Duration(0), time.Duration(math.MaxInt64)
+	for i, node := range path {
+		ceilDelay = max(ceilDelay, limiterDelay(node.ceil[l.d], now, n))
+		if delay := max(ceilDelay, limiterDelay(node.assured[l.d], now, n)); delay < lenderDelay {
+			lender, lenderDelay = i, delay
+		}
+	}
+
+	for i, node := range path {
+		ceil, err := node.ceil[l.d].ReserveN(now, n)
+		if err != nil {
+			r.Cancel()
+			return nil, err
+		}
+		r.refunds = append(r.refunds, ceil.refunds...)
+		if i <= lender && ceil.timeToAct.After(r.timeToAct) {
+			r.timeToAct = ceil.timeToAct
+		}
+
+		if i < lender {
+			// Guaranteed rate of the node is exhausted, so bytes are borrowed from the lender.
+			continue
+		}
+		assured, err := node.assured[l.d].ReserveN(now, n)
+		if err != nil {
+			r.Cancel()
+			return nil, err
+		}
+		r.refunds = append(r.refunds, assured.refunds...)
+		if i == lender && assured.timeToAct.After(r.timeToAct) {
+			r.timeToAct = assured.timeToAct
+		}
+	}
+
+	return r, nil
+}
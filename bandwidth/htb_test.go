@@ -0,0 +1,197 @@
+package bandwidth
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTBSet(t *testing.T) {
+	h := newHTB()
+	require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(10), bothDirections...))
+	require.NoError(t, h.Set("a", "root", NewConfig(5), NewConfig(10), bothDirections...))
+	require.NoError(t, h.Set("b", "a", NewConfig(5), NewConfig(10), readDirection))
+
+	assert.Error(t, h.Set("", "root", NewConfig(5), NewConfig(10), bothDirections...), "empty name")
+	assert.Error(t, h.Set("c", "unknown", NewConfig(5), NewConfig(10), bothDirections...), "unknown parent")
+	assert.Error(t, h.Set("c", "root", NewConfig(20), NewConfig(10), bothDirections...), "guaranteed rate exceeds ceiling")
+	assert.Error(t, h.Set("c", "root", NewUnlimitedConfig(), NewConfig(10), bothDirections...), "guaranteed rate exceeds ceiling")
+	assert.Error(t, h.Set("root", "b", NewConfig(10), NewConfig(10), bothDirections...), "cycle")
+	assert.Error(t, h.Set("a", "a", NewConfig(10), NewConfig(10), bothDirections...), "cycle")
+
+	b := h.nodes["b"]
+	assert.Same(t, h.nodes["a"], b.parent)
+	assert.Equal(t, NewConfig(5), limiterConfig(b.assured[readDirection]))
+	assert.Equal(t, NewUnlimitedConfig(), limiterConfig(b.assured[writeDirection]), "new node is unlimited")
+
+	// Change parent and config at runtime.
+	require.NoError(t, h.Set("b", "root", NewConfig(2), NewConfig(4), writeDirection))
+	assert.Same(t, h.nodes["root"], b.parent)
+	assert.Equal(t, 2, h.nodes["root"].children)
+	assert.Equal(t, 0, h.nodes["a"].children)
+	assert.Equal(t, NewConfig(5), limiterConfig(b.assured[readDirection]))
+	assert.Equal(t, NewConfig(2), limiterConfig(b.assured[writeDirection]))
+	assert.Equal(t, NewConfig(4), limiterConfig(b.ceil[writeDirection]))
+}
+
+func TestHTBRemove(t *testing.T) {
+	h := newHTB()
+	require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(10), bothDirections...))
+	require.NoError(t, h.Set("a", "root", NewConfig(5), NewConfig(10), bothDirections...))
+
+	assert.Error(t, h.Remove("root"), "node has children")
+	assert.Error(t, h.Remove("unknown"))
+	require.NoError(t, h.Remove("a"))
+	require.NoError(t, h.Remove("root"))
+	assert.Empty(t, h.nodes)
+}
+
+func TestHTBLimiterBurst(t *testing.T) {
+	h := newHTB()
+	l := h.Limiter("a", writeDirection)
+	assert.Equal(t, math.MaxInt, l.Burst(), "unknown node is unlimited")
+
+	require.NoError(t, h.Set("root", "", NewConfig(10, 7), NewConfig(10), bothDirections...))
+	require.NoError(t, h.Set("a", "root", NewConfig(5, 8), NewConfig(10, 9), bothDirections...))
+	assert.Equal(t, 7, l.Burst())
+}
+
+func TestHTBLimiterReserveN(t *testing.T) {
+	t.Run("unknown node is unlimited", func(t *testing.T) {
+		h := newHTB()
+		now := time.Now()
+		r, err := h.Limiter("a", writeDirection).ReserveN(now, 100)
+		require.NoError(t, err)
+		assert.Equal(t, now, r.timeToAct)
+	})
+
+	t.Run("borrowing idle capacity up to the ceiling", func(t *testing.T) {
+		h := newHTB()
+		require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(10), bothDirections...))
+		require.NoError(t, h.Set("a", "root", NewConfig(4, 10), NewConfig(10), bothDirections...))
+		require.NoError(t, h.Set("b", "root", NewConfig(6, 10), NewConfig(10), bothDirections...))
+		a := h.Limiter("a", writeDirection)
+		now := time.Now()
+
+		r, err := a.ReserveN(now, 10)
+		require.NoError(t, err)
+		assert.Equal(t, now, r.timeToAct)
+
+		// Class "a" has guaranteed 4 B/s, but class "b" is idle, so "a" can use the whole root's rate.
+		r, err = a.ReserveN(now, 10)
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(time.Second), r.timeToAct)
+	})
+
+	t.Run("ceiling is not exceeded", func(t *testing.T) {
+		h := newHTB()
+		require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(10), bothDirections...))
+		require.NoError(t, h.Set("a", "root", NewConfig(4, 10), NewConfig(5, 10), bothDirections...))
+		a := h.Limiter("a", writeDirection)
+		now := time.Now()
+
+		_, err := a.ReserveN(now, 10)
+		require.NoError(t, err)
+		r, err := a.ReserveN(now, 10)
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(2*time.Second), r.timeToAct)
+	})
+
+	t.Run("guaranteed rate is available when ancestors are exhausted", func(t *testing.T) {
+		h := newHTB()
+		require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(20), bothDirections...))
+		require.NoError(t, h.Set("a", "root", NewConfig(5), NewConfig(20), bothDirections...))
+		require.NoError(t, h.Set("b", "root", NewConfig(5), NewConfig(20), bothDirections...))
+		a, b := h.Limiter("a", readDirection), h.Limiter("b", readDirection)
+		now := time.Now()
+
+		// Class "b" uses its guaranteed bytes, and then it borrows from root.
+		for i := 0; i < 2; i++ {
+			r, err := b.ReserveN(now, 5)
+			require.NoError(t, err)
+			assert.Equal(t, now, r.timeToAct)
+		}
+
+		// Root does not have idle capacity, so class "b" must wait.
+		r, err := b.ReserveN(now, 5)
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(500*time.Millisecond), r.timeToAct)
+
+		// Class "a" still has its guaranteed bytes.
+		r, err = a.ReserveN(now, 5)
+		require.NoError(t, err)
+		assert.Equal(t, now, r.timeToAct)
+	})
+
+	t.Run("guaranteed rate is not taken by busier nodes", func(t *testing.T) {
+		h := newHTB()
+		require.NoError(t, h.Set("root", "", NewConfig(1000), NewConfig(1000), bothDirections...))
+		require.NoError(t, h.Set("a", "root", NewConfig(500), NewConfig(1000), bothDirections...))
+		require.NoError(t, h.Set("b", "root", NewConfig(500), NewConfig(1000), bothDirections...))
+
+		// One connection of "a" and nine connections of "b" reserve 100 bytes as soon as previous bytes are used.
+		type conn struct {
+			limiter htbLimiter
+			next    time.Time
+			bytes   int
+		}
+		start := time.Now()
+		conns := []*conn{{limiter: h.Limiter("a", writeDirection), next: start}}
+		for i := 0; i < 9; i++ {
+			conns = append(conns, &conn{limiter: h.Limiter("b", writeDirection), next: start})
+		}
+		end := start.Add(10 * time.Second)
+		for {
+			c := slices.MinFunc(conns, func(a, b *conn) int {
+				return a.next.Compare(b.next)
+			})
+			if !c.next.Before(end) {
+				break
+			}
+			r, err := c.limiter.ReserveN(c.next, 100)
+			require.NoError(t, err)
+			c.next = r.timeToAct
+			if c.next.Before(end) {
+				c.bytes += 100
+			}
+		}
+
+		b := 0
+		for _, c := range conns[1:] {
+			b += c.bytes
+		}
+		assert.GreaterOrEqual(t, conns[0].bytes, 5000, "class a must get its guaranteed 500 B/s")
+		assert.GreaterOrEqual(t, b, 5000, "class b must get its guaranteed 500 B/s")
+		assert.LessOrEqual(t, conns[0].bytes+b, 10000+2000, "root's rate must not be exceeded, except for bursts")
+	})
+
+	t.Run("canceled reservation returns bytes to all nodes", func(t *testing.T) {
+		h := newHTB()
+		require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(10), bothDirections...))
+		require.NoError(t, h.Set("a", "root", NewConfig(5, 10), NewConfig(10), bothDirections...))
+		a := h.Limiter("a", writeDirection)
+
+		r, err := a.ReserveN(time.Now(), 10)
+		require.NoError(t, err)
+		assert.Len(t, r.refunds, 4)
+		r.Cancel()
+		for _, name := range []string{"root", "a"} {
+			assert.InDelta(t, 10, tokens(h.nodes[name].assured[writeDirection]), 0.1)
+			assert.InDelta(t, 10, tokens(h.nodes[name].ceil[writeDirection]), 0.1)
+		}
+	})
+
+	t.Run("bytes exceed burst", func(t *testing.T) {
+		h := newHTB()
+		require.NoError(t, h.Set("root", "", NewConfig(10), NewConfig(10), bothDirections...))
+		require.NoError(t, h.Set("a", "root", NewConfig(5), NewConfig(10), bothDirections...))
+
+		_, err := h.Limiter("a", writeDirection).ReserveN(time.Now(), 6)
+		require.Error(t, err)
+		assert.InDelta(t, 10, tokens(h.nodes["a"].ceil[writeDirection]), 0.1, "reserved bytes must be returned")
+	})
+}
@@ -0,0 +1,130 @@
+package bandwidth
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// ipOverrides keeps limits of connections from given IP addresses or subnets.
+// Each subnet has a limit shared by all its connections and a limit config for each of them,
+// which is used instead of listener's or class's connection limit.
+type ipOverrides struct {
+	mutex  sync.Mutex
+	groups map[netip.Prefix]*limitGroup
+	// sorted are subnets of groups ordered from the most specific one. They are sorted when subnets are added
+	// or removed, so accepted connections are matched without sorting.
+	sorted []netip.Prefix
+	// clock is used by limiters of new subnets.
+	clock Clock
+	// newLimiter creates limiters of new subnets.
+	newLimiter LimiterFactory
+}
+
+func newIPOverrides() *ipOverrides {
+	return &ipOverrides{
+		groups:     make(map[netip.Prefix]*limitGroup),
+		clock:      systemClock{},
+		newLimiter: newBucketLimiter,
+	}
+}
+
+// Get returns limits of a given subnet.
+// When the subnet does not exist, then new unlimited subnet is created.
+func (o *ipOverrides) Get(prefix netip.Prefix) *limitGroup {
+	prefix = prefix.Masked()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	g, ok := o.groups[prefix]
+	if !ok {
+		g = &limitGroup{}
+		// Connection limit of a new subnet is inherited from the class or the listener.
+		g.init(o.clock, o.newLimiter, Config{})
+		o.groups[prefix] = g
+		o.sort()
+	}
+
+	return g
+}
+
+// Lookup returns limits of a given subnet. It returns false when the subnet does not have limits.
+func (o *ipOverrides) Lookup(prefix netip.Prefix) (*limitGroup, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	g, ok := o.groups[prefix.Masked()]
+
+	return g, ok
+}
+
+// Remove removes limits of a given subnet, so next connections from it are not overridden.
+func (o *ipOverrides) Remove(prefix netip.Prefix) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if _, ok := o.groups[prefix.Masked()]; ok {
+		delete(o.groups, prefix.Masked())
+		o.sort()
+	}
+}
+
+// inheritedChanged informs connections of all subnets that connection config of a class or the listener
+// has been changed.
+func (o *ipOverrides) inheritedChanged() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, g := range o.groups {
+		g.inheritedChanged()
+	}
+}
+
+// Prefixes returns all subnets which have limits, ordered from the most specific one.
+func (o *ipOverrides) Prefixes() []netip.Prefix {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return slices.Clone(o.sorted)
+}
+
+// sort sorts all subnets from the most specific one. It requires that mutex is held.
+func (o *ipOverrides) sort() {
+	o.sorted = o.sorted[:0]
+	for prefix := range o.groups {
+		o.sorted = append(o.sorted, prefix)
+	}
+	slices.SortFunc(o.sorted, func(a, b netip.Prefix) int {
+		if a.Bits() != b.Bits() {
+			return b.Bits() - a.Bits()
+		}
+
+		return a.Addr().Compare(b.Addr())
+	})
+}
+
+// Match returns limits of the most specific subnet which contains remote address of a given connection.
+// It returns false when no subnet matches, and remote address is not checked when there are no subnets.
+func (o *ipOverrides) Match(conn net.Conn) (*limitGroup, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.groups) == 0 {
+		return nil, false
+	}
+
+	ip, ok := remoteIP(conn.RemoteAddr())
+	if !ok {
+		return nil, false
+	}
+
+	for _, prefix := range o.sorted {
+		if prefix.Contains(ip) {
+			return o.groups[prefix], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,40 @@
+package bandwidth
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPOverrides(t *testing.T) {
+	o := newIPOverrides()
+	_, ok := o.Match(mockConn{})
+	assert.False(t, ok, "remote address must not be checked without subnets")
+
+	subnet := o.Get(netip.MustParsePrefix("10.0.0.1/8"))
+	host := o.Get(netip.MustParsePrefix("10.0.0.1/32"))
+	assert.Equal(t, subnet, o.Get(netip.MustParsePrefix("10.0.0.0/8")), "subnets must be masked")
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("10.0.0.0/8")},
+		o.Prefixes())
+
+	g, ok := o.Match(mockAddrConn{addr: mockAddr("10.0.0.1:1000")})
+	require.True(t, ok)
+	assert.Equal(t, host, g, "the most specific subnet must be used")
+
+	g, ok = o.Match(mockAddrConn{addr: mockAddr("[::ffff:10.0.0.2]:1000")})
+	require.True(t, ok)
+	assert.Equal(t, subnet, g)
+
+	_, ok = o.Match(mockAddrConn{addr: mockAddr("192.168.0.1:1000")})
+	assert.False(t, ok)
+
+	o.Remove(netip.MustParsePrefix("10.0.0.1/32"))
+	_, ok = o.Lookup(netip.MustParsePrefix("10.0.0.1/32"))
+	assert.False(t, ok)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, o.Prefixes())
+	g, ok = o.Match(mockAddrConn{addr: mockAddr("10.0.0.1:1000")})
+	require.True(t, ok)
+	assert.Equal(t, subnet, g)
+}
@@ -0,0 +1,98 @@
+package bandwidth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// leakyBucket is a leaky bucket rate limiter where bytes leave the bucket with a constant rate.
+// Unlike token bucket, it does not collect unused bytes, so bytes are paced smoothly even after idle time.
+type leakyBucket struct {
+	mutex sync.Mutex
+	limit rate.Limit
+	burst int
+	// next is a time when the next bytes can be used. It is in the past when the bucket is empty.
+	next time.Time
+}
+
+// newLeakyBucket returns empty leaky bucket for a given config.
+func newLeakyBucket(c Config) *leakyBucket {
+	return &leakyBucket{limit: c.limit, burst: c.burst}
+}
+
+// Config returns current config of the leaky bucket.
+func (lb *leakyBucket) Config() Config {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	return Config{limit: lb.limit, burst: lb.burst, algorithm: LeakyBucket}
+}
+
+// SetConfig sets new limit and burst.
+// Bytes which have been already reserved are not affected.
+func (lb *leakyBucket) SetConfig(_ time.Time, c Config) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.limit = c.limit
+	lb.burst = c.burst
+}
+
+// IsFull returns true when all reserved bytes have left the bucket at time now.
+func (lb *leakyBucket) IsFull(now time.Time) bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	return !lb.next.After(now)
+}
+
+// ReserveN reserves n bytes at time now. Bytes can be used after all bytes reserved before have left the bucket.
+// It returns an error when n exceeds the burst.
+func (lb *leakyBucket) ReserveN(now time.Time, n int) (*Reservation, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	r := &Reservation{refunds: []func(n int){lb.returnN}, tokens: n, timeToAct: now}
+	if lb.limit == rate.Inf {
+		return r, nil
+	}
+
+	if n > lb.burst {
+		return nil, fmt.Errorf("bandwidth: can not reserve %d bytes, because it exceeds burst %d", n, lb.burst)
+	}
+
+	if lb.next.After(now) {
+		r.timeToAct = lb.next
+	}
+	lb.next = r.timeToAct.Add(durationFromTokens(lb.limit, float64(n)))
+
+	return r, nil
+}
+
+// Delay returns how long it takes until bytes reserved before have left the bucket at time now.
+// It returns zero when n exceeds the burst, because such reservation fails immediately.
+func (lb *leakyBucket) Delay(now time.Time, n int) time.Duration {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.limit == rate.Inf || n > lb.burst {
+		return 0
+	}
+
+	return max(lb.next.Sub(now), 0)
+}
+
+// returnN returns n unused bytes, so the next bytes can be used earlier.
+func (lb *leakyBucket) returnN(n int) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if lb.limit == rate.Inf {
+		return
+	}
+
+	lb.next = lb.next.Add(-durationFromTokens(lb.limit, float64(n)))
+}
@@ -0,0 +1,50 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeakyBucketReserveN(t *testing.T) {
+	lb := newLeakyBucket(NewConfig(10))
+	now := time.Now()
+
+	r, err := lb.ReserveN(now, 5)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct)
+
+	// Bytes are paced with the limit, even when they do not exceed the burst.
+	r, err = lb.ReserveN(now, 5)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(500*time.Millisecond), r.timeToAct)
+	assert.Equal(t, time.Second, lb.Delay(now, 1))
+
+	// Idle time does not allow for bursts.
+	later := now.Add(time.Hour)
+	assert.True(t, lb.IsFull(later))
+	r, err = lb.ReserveN(later, 10)
+	require.NoError(t, err)
+	assert.Equal(t, later, r.timeToAct)
+	r, err = lb.ReserveN(later, 1)
+	require.NoError(t, err)
+	assert.Equal(t, later.Add(time.Second), r.timeToAct)
+
+	_, err = lb.ReserveN(later, 11)
+	require.Error(t, err, "it must not be possible to reserve more than burst")
+}
+
+func TestLeakyBucketReturnN(t *testing.T) {
+	lb := newLeakyBucket(NewConfig(10))
+	now := time.Now()
+
+	r, err := lb.ReserveN(now, 10)
+	require.NoError(t, err)
+	r.ReturnN(4)
+
+	r, err = lb.ReserveN(now, 1)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(600*time.Millisecond), r.timeToAct, "returned bytes must not be paced")
+}
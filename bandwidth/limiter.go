@@ -0,0 +1,280 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter is a rate limiter of bytes used by listeners and connections, and by streams which are not
+// network connections. Built-in limiters are created by Config.NewLimiter, and their algorithm is selected
+// by the config, see Config.WithAlgorithm. Custom limiters can be used by listeners, see WithLimiterFactory.
+type Limiter interface {
+	// Limit returns the maximum rate of bytes per second.
+	Limit() rate.Limit
+	// Burst returns the maximum number of bytes which can be reserved at once.
+	Burst() int
+	// SetRate sets a new rate at time now. Bytes which have been already reserved are not affected.
+	SetRate(now time.Time, limit rate.Limit)
+	// SetBurst sets a new burst at time now. Bytes which have been already reserved are not affected.
+	SetBurst(now time.Time, burst int)
+	// ReserveN reserves n bytes at time now. Returned reservation says when bytes can be used,
+	// and it allows for returning bytes which have not been used.
+	// It returns an error when n exceeds the burst, because such reservation could never be fulfilled.
+	ReserveN(now time.Time, n int) (*Reservation, error)
+	// WaitN blocks until n bytes can be used or the context is done. It waits with the limiter's clock.
+	WaitN(ctx context.Context, n int) error
+}
+
+// LimiterFactory returns a new limiter for a given config, see WithLimiterFactory.
+// Zero Config is not given to it, unlimited config is given instead.
+type LimiterFactory func(c Config) Limiter
+
+// newBucketLimiter returns a built-in limiter, which uses the config's algorithm. It is the default LimiterFactory.
+func newBucketLimiter(c Config) Limiter {
+	return newBucket(c)
+}
+
+// NewReservation returns a reservation of n bytes, which can be used at time timeToAct.
+// Bytes returned by Reservation.ReturnN or Reservation.Cancel are passed to returnN, which can be nil.
+// It allows for implementing Limiter.ReserveN by custom limiters.
+func NewReservation(n int, timeToAct time.Time, returnN func(n int)) *Reservation {
+	r := &Reservation{tokens: n, timeToAct: timeToAct}
+	if returnN != nil {
+		r.refunds = []func(n int){returnN}
+	}
+
+	return r
+}
+
+// configurable is a limiter which can change its algorithm, e.g. a built-in limiter.
+type configurable interface {
+	Config() Config
+	SetConfig(now time.Time, c Config)
+}
+
+// delayer is a limiter which tells how long it takes until bytes can be reserved without reserving them.
+type delayer interface {
+	Delay(now time.Time, n int) time.Duration
+}
+
+// fullChecker is a limiter which tells whether it behaves like a new one.
+type fullChecker interface {
+	IsFull(now time.Time) bool
+}
+
+// limiterConfig returns current config of a given limiter.
+// Algorithm of a custom limiter is unknown, so its config has the default algorithm.
+func limiterConfig(l Limiter) Config {
+	if c, ok := l.(configurable); ok {
+		return c.Config()
+	}
+
+	return Config{limit: l.Limit(), burst: l.Burst()}
+}
+
+// setLimiterConfig sets a new config of a given limiter at time now. Zero Config is unlimited.
+// Algorithm of a custom limiter can not be changed, so only its rate and burst are set.
+func setLimiterConfig(l Limiter, now time.Time, c Config) {
+	if cl, ok := l.(configurable); ok {
+		cl.SetConfig(now, c)
+		return
+	}
+
+	c = orUnlimited(c)
+	l.SetRate(now, c.limit)
+	l.SetBurst(now, c.burst)
+}
+
+// limiterDelay returns how long it takes until n bytes can be reserved in a given limiter without waiting at time now.
+// It returns zero when n exceeds the burst, because such reservation fails immediately.
+// Custom limiter is asked by a reservation, which is canceled.
+func limiterDelay(l Limiter, now time.Time, n int) time.Duration {
+	if dl, ok := l.(delayer); ok {
+		return dl.Delay(now, n)
+	}
+
+	r, err := l.ReserveN(now, n)
+	if err != nil {
+		return 0
+	}
+	defer r.Cancel()
+
+	return r.DelayFrom(now)
+}
+
+// limiterIsFull returns true when a given limiter at time now behaves like a new one.
+// Custom limiter is full when its whole burst can be reserved without waiting.
+func limiterIsFull(l Limiter, now time.Time) bool {
+	if fc, ok := l.(fullChecker); ok {
+		return fc.IsFull(now)
+	}
+
+	return limiterDelay(l, now, l.Burst()) == 0
+}
+
+// waitingLimiter waits for a Limiter with a clock and a deadline of a connection.
+type waitingLimiter struct {
+	Limiter
+}
+
+// waitN reserves n bytes and waits until they can be used.
+func (l waitingLimiter) waitN(ctx context.Context, clock Clock, dl *deadline, n int) (*Reservation, error) {
+	return reserveAndWait(ctx, clock, dl, l.Limiter, n)
+}
+
+// Algorithm is an algorithm of a rate limiter.
+type Algorithm int
+
+const (
+	// TokenBucket collects unused bytes up to the burst, so bytes can be used at once after idle time.
+	TokenBucket Algorithm = iota
+	// LeakyBucket paces bytes smoothly with the limit. It does not collect unused bytes,
+	// so idle time does not allow for bursts, and the burst is only the maximum size of a single read or write.
+	LeakyBucket
+	// SlidingWindow allows for at most burst bytes in any window of burst/limit seconds,
+	// e.g. limit bytes in any second when the burst is the same as the limit.
+	SlidingWindow
+)
+
+// String returns a name of the algorithm.
+func (a Algorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token-bucket"
+	case LeakyBucket:
+		return "leaky-bucket"
+	case SlidingWindow:
+		return "sliding-window"
+	default:
+		return fmt.Sprintf("Algorithm(%d)", int(a))
+	}
+}
+
+// rateAlgorithm is an implementation of an algorithm used by bucket.
+type rateAlgorithm interface {
+	reserver
+	// Config returns current config of the limiter.
+	Config() Config
+	// SetConfig sets new limit and burst at time now. Bytes which have been already reserved are not affected.
+	SetConfig(now time.Time, c Config)
+	// Delay returns how long it takes until n bytes can be reserved without waiting at time now.
+	// It returns zero when n exceeds the burst, because such reservation fails immediately.
+	Delay(now time.Time, n int) time.Duration
+	// IsFull returns true when the limiter at time now behaves like a new one.
+	IsFull(now time.Time) bool
+}
+
+// bucket is a limiter which uses an algorithm selected by its config.
+// Algorithm is replaced when a config with another algorithm is set, and the new one starts full.
+type bucket struct {
+	mutex sync.Mutex
+	impl  rateAlgorithm
+	// clock is used by WaitN. Other methods get time from their callers.
+	clock Clock
+}
+
+var _ Limiter = (*bucket)(nil)
+
+// newBucket returns a full limiter for a given config. Zero Config is unlimited.
+func newBucket(c Config) *bucket {
+	return &bucket{impl: newRateAlgorithm(orUnlimited(c)), clock: systemClock{}}
+}
+
+// newRateAlgorithm returns a full limiter which implements the config's algorithm.
+func newRateAlgorithm(c Config) rateAlgorithm {
+	switch c.algorithm {
+	case LeakyBucket:
+		return newLeakyBucket(c)
+	case SlidingWindow:
+		return newSlidingWindow(c)
+	default:
+		return newTokenBucket(c)
+	}
+}
+
+// algorithm returns current implementation of the limiter.
+func (b *bucket) algorithm() rateAlgorithm {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.impl
+}
+
+// Config returns current config of the limiter.
+func (b *bucket) Config() Config {
+	return b.algorithm().Config()
+}
+
+// SetConfig sets a new config at time now.
+func (b *bucket) SetConfig(now time.Time, c Config) {
+	b.update(now, func(Config) Config {
+		return c
+	})
+}
+
+// update sets a config returned by a given function for current config. Zero Config is unlimited.
+func (b *bucket) update(now time.Time, change func(c Config) Config) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c := orUnlimited(change(b.impl.Config()))
+	if c.algorithm != b.impl.Config().algorithm {
+		b.impl = newRateAlgorithm(c)
+		return
+	}
+
+	b.impl.SetConfig(now, c)
+}
+
+// Limit returns the maximum rate of bytes per second.
+func (b *bucket) Limit() rate.Limit {
+	return b.Config().limit
+}
+
+// Burst returns the maximum number of bytes which can be reserved at once.
+func (b *bucket) Burst() int {
+	return b.Config().burst
+}
+
+// SetRate sets a new rate at time now. When the limiter is unlimited, then the burst is the same as the new rate.
+func (b *bucket) SetRate(now time.Time, limit rate.Limit) {
+	b.update(now, func(c Config) Config {
+		if c.limit == rate.Inf {
+			return NewConfig(limit).WithAlgorithm(c.algorithm)
+		}
+
+		return NewConfig(limit, c.burst).WithAlgorithm(c.algorithm)
+	})
+}
+
+// SetBurst sets a new burst at time now. It does not have effect when the limiter is unlimited.
+func (b *bucket) SetBurst(now time.Time, burst int) {
+	b.update(now, func(c Config) Config {
+		return NewConfig(c.limit, burst).WithAlgorithm(c.algorithm)
+	})
+}
+
+// ReserveN reserves n bytes at time now.
+func (b *bucket) ReserveN(now time.Time, n int) (*Reservation, error) {
+	return b.algorithm().ReserveN(now, n)
+}
+
+// WaitN blocks until n bytes can be used or the context is done.
+func (b *bucket) WaitN(ctx context.Context, n int) error {
+	_, err := reserveAndWait(ctx, b.clock, nil, b, n)
+	return err
+}
+
+// Delay returns how long it takes until n bytes can be reserved without waiting at time now.
+func (b *bucket) Delay(now time.Time, n int) time.Duration {
+	return b.algorithm().Delay(now, n)
+}
+
+// IsFull returns true when the limiter at time now behaves like a new one.
+func (b *bucket) IsFull(now time.Time) bool {
+	return b.algorithm().IsFull(now)
+}
@@ -0,0 +1,163 @@
+package bandwidth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestBucketAlgorithm(t *testing.T) {
+	now := time.Now()
+	for _, algorithm := range []Algorithm{TokenBucket, LeakyBucket, SlidingWindow} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			cfg := NewConfig(10).WithAlgorithm(algorithm)
+			b := newBucket(cfg)
+			assert.Equal(t, cfg, b.Config())
+
+			// Every algorithm allows for burst bytes at once at the beginning, and then it waits.
+			r, err := b.ReserveN(now, 10)
+			require.NoError(t, err)
+			assert.Equal(t, time.Duration(0), r.DelayFrom(now))
+			r, err = b.ReserveN(now, 10)
+			require.NoError(t, err)
+			assert.Equal(t, time.Second, r.DelayFrom(now))
+			assert.False(t, b.IsFull(now))
+
+			_, err = b.ReserveN(now, 11)
+			require.Error(t, err, "it must not be possible to reserve more than burst")
+		})
+	}
+}
+
+func TestBucketSetConfig(t *testing.T) {
+	now := time.Now()
+	b := newBucket(NewConfig(10))
+	_, err := b.ReserveN(now, 10)
+	require.NoError(t, err)
+
+	// Limiter is replaced, and the new one is full, when algorithm is changed.
+	b.SetConfig(now, NewConfig(10).WithAlgorithm(LeakyBucket))
+	assert.Equal(t, LeakyBucket, b.Config().Algorithm())
+	assert.True(t, b.IsFull(now))
+
+	b.SetRate(now, 20)
+	assert.Equal(t, NewConfig(20, 10).WithAlgorithm(LeakyBucket), b.Config())
+	b.SetBurst(now, 5)
+	assert.Equal(t, NewConfig(20, 5).WithAlgorithm(LeakyBucket), b.Config())
+
+	// Burst of unlimited limiter is the same as a new rate.
+	b.SetConfig(now, NewUnlimitedConfig())
+	b.SetBurst(now, 5)
+	assert.Equal(t, NewUnlimitedConfig(), b.Config())
+	b.SetRate(now, 30)
+	assert.Equal(t, rate.Limit(30), b.Limit())
+	assert.Equal(t, 30, b.Burst())
+}
+
+func TestBucketWaitN(t *testing.T) {
+	clock := newTestClock()
+	var l Limiter = NewConfig(100).WithAlgorithm(SlidingWindow).NewLimiter(clock)
+	require.NoError(t, l.WaitN(context.Background(), 100))
+
+	// The next bytes wait for the limiter's clock.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, l.WaitN(context.Background(), 10))
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "wait must be finished after a second")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, l.WaitN(ctx, 10), context.Canceled)
+}
+
+// countingLimiter is a custom limiter, which counts bytes reserved in a built-in limiter.
+// It does not implement optional methods of built-in limiters, e.g. Delay and IsFull.
+type countingLimiter struct {
+	Limiter
+	mutex    sync.Mutex
+	reserved int
+}
+
+func (l *countingLimiter) ReserveN(now time.Time, n int) (*Reservation, error) {
+	r, err := l.Limiter.ReserveN(now, n)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.reserved += n
+
+	return NewReservation(n, now.Add(r.DelayFrom(now)), func(n int) {
+		r.ReturnN(n)
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		l.reserved -= n
+	}), nil
+}
+
+// Reserved returns a number of reserved bytes, which have not been returned.
+func (l *countingLimiter) Reserved() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.reserved
+}
+
+func TestNewReservation(t *testing.T) {
+	now := time.Now()
+	var returned int
+	r := NewReservation(10, now.Add(time.Second), func(n int) {
+		returned += n
+	})
+	assert.Equal(t, time.Second, r.DelayFrom(now))
+	r.ReturnN(4)
+	r.Cancel()
+	r.Cancel()
+	assert.Equal(t, 10, returned, "reserved bytes are returned once")
+
+	assert.NotPanics(t, NewReservation(10, now, nil).Cancel)
+}
+
+func TestCustomLimiter(t *testing.T) {
+	now := time.Now()
+	l := &countingLimiter{Limiter: NewConfig(10).NewLimiter()}
+	assert.Equal(t, NewConfig(10), limiterConfig(l))
+	assert.True(t, limiterIsFull(l, now))
+	assert.Equal(t, time.Duration(0), limiterDelay(l, now, 10))
+	assert.Zero(t, l.Reserved(), "bytes reserved by delay are returned")
+
+	r, err := l.ReserveN(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 10, l.Reserved())
+	assert.False(t, limiterIsFull(l, now))
+	assert.Equal(t, time.Second, limiterDelay(l, now, 10))
+	r.Cancel()
+	assert.Zero(t, l.Reserved())
+
+	setLimiterConfig(l, now, NewConfig(20, 5))
+	assert.Equal(t, NewConfig(20, 5), limiterConfig(l))
+	setLimiterConfig(l, now, Config{})
+	assert.Equal(t, NewUnlimitedConfig(), limiterConfig(l), "zero config is unlimited")
+}
+
+// tokens returns a number of available tokens of a limiter, which must be a token bucket.
+func tokens(l Limiter) float64 {
+	return l.(*bucket).algorithm().(*tokenBucket).tokens
+}
@@ -2,89 +2,638 @@ package bandwidth
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"os"
+	"os/signal"
 	"sync"
-
-	"golang.org/x/time/rate"
+	"syscall"
+	"time"
 )
 
 type listener struct {
 	// Listener is an original listener which wrapped by bandwidth listener.
 	net.Listener
 	// ctx is a context which can be canceled, so all Write functions will be canceled immediately.
-	ctx context.Context
-	// c is closed when configuration for connections is changed, so all existing connections can read new config.
-	c     chan struct{}
-	mutex sync.RWMutex
-	// limitCfgConn is current limit config for a connection.
-	limitCfgConn config
-	// limitCfgGlobal is a current global limit.
-	limitCfgGlobal config
-	// sharedLimiter is a shared global rate limiter across all connections.
-	sharedLimiter *rate.Limiter
+	// It is also canceled when the listener is closed and connections should be closed too.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// closeConns is true when closing the listener should interrupt all accepted connections.
+	closeConns bool
+	// limitGroup keeps global rate limiter shared across all connections and connection limit config.
+	limitGroup
+	// sources keeps rate limiters shared by connections from the same remote IP address or subnet.
+	sources *sourceLimiters
+	// classes keeps traffic classes of connections.
+	classes *classes
+	// ips keeps limits of connections from given IP addresses or subnets.
+	ips *ipOverrides
+	// htb is a hierarchical token bucket. Connections are attached to its nodes by their traffic classes.
+	htb *htb
+	// fair is a fair scheduler of global limiter per direction. It is nil when fair sharing is not enabled.
+	fair [directions]*fairScheduler
+	// prioritizer returns weights and priorities of accepted connections. It is nil when it is not set.
+	prioritizer Prioritizer
+	// quotas keeps byte quotas of connections by their keys.
+	quotas *quotas
+	// store keeps usage of quotas, so it survives restarts. It is nil when usage is not persisted.
+	store Store
+	// flushInterval is how often usage is saved into the store. Zero means that it is saved only on shutdown.
+	flushInterval time.Duration
+	// clock tells the time for limiters, quotas and schedules.
+	clock Clock
+	// newLimiter creates limiters of connections.
+	newLimiter LimiterFactory
+	// schedule drives global and connection limits. It is nil when limits are set only manually.
+	schedule *Schedule
+	// configPath is a path of a config file. It is empty when limits are not loaded from a file.
+	configPath string
+	// configPollInterval is how often the config file is checked for changes. Zero means only on SIGHUP.
+	configPollInterval time.Duration
+	// configErrors is called with errors of reloading the config file. It is nil when errors are ignored.
+	configErrors func(err error)
+	// configMutex serializes applying of config files.
+	configMutex sync.Mutex
+	// fileCfg is the last applied config file. It is nil when no config file has been applied.
+	fileCfg *FileConfig
+	// traffic counts traffic of all accepted connections.
+	traffic traffic
+	// unclassified counts traffic of connections which do not belong to any class.
+	unclassified traffic
+	// observer is notified about connections, throttling and changes of limits.
+	observer Observer
+	// conns keeps connections which have been accepted and have not been closed yet.
+	conns *connRegistry
+	// limitsMutex serializes changes of global and connection limits, so the observer gets consistent old and new limits.
+	limitsMutex sync.Mutex
+	// closed is closed when the listener is closed, so background goroutines can stop.
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // NewListener returns bandwidth listener with default infinite global and connection limiters.
 // If a given context is canceled then all writes and reads should be interrupted (e.g. SIGTERM was sent).
-func NewListener(ctx context.Context, l net.Listener) *listener {
+// Options which load files, i.e. WithStore and WithConfigFile, require NewListenerWithError,
+// which returns loading errors, so NewListener panics when they are given.
+func NewListener(ctx context.Context, l net.Listener, opts ...Option) *listener {
+	bl := newListener(ctx, l, opts...)
+	if bl.store != nil || bl.configPath != "" {
+		bl.cancel(net.ErrClosed)
+		panic("bandwidth: WithStore and WithConfigFile options require NewListenerWithError")
+	}
+	// Nothing is loaded without a store and a config file, so starting does not fail.
+	_ = bl.start()
+
+	return bl
+}
+
+// NewListenerWithError returns bandwidth listener like NewListener, but it returns an error
+// when the listener can not be initialized, e.g. usage of quotas can not be loaded from a store,
+// or a config file is invalid. All options can be used with it.
+// The parent listener is not closed on error. Invalid options still panic, because they are programming errors.
+func NewListenerWithError(ctx context.Context, l net.Listener, opts ...Option) (*listener, error) {
+	bl := newListener(ctx, l, opts...)
+	if err := bl.start(); err != nil {
+		return nil, err
+	}
+
+	return bl, nil
+}
+
+// newListener returns bandwidth listener with given options, which has not been started yet.
+func newListener(ctx context.Context, l net.Listener, opts ...Option) *listener {
 	if l == nil {
 		panic("parent listener must be provided")
 	}
 
-	unlimited := NewUnlimitedConfig()
-	return &listener{
-		Listener:       l,
-		ctx:            ctx,
-		c:              make(chan struct{}),
-		limitCfgConn:   unlimited,
-		limitCfgGlobal: unlimited,
-		sharedLimiter:  unlimited.NewRateLimiter(),
+	ctx, cancel := context.WithCancelCause(ctx)
+	bl := &listener{
+		Listener:   l,
+		ctx:        ctx,
+		cancel:     cancel,
+		sources:    newSourceLimiters(),
+		classes:    newClasses(),
+		ips:        newIPOverrides(),
+		htb:        newHTB(),
+		quotas:     newQuotas(),
+		clock:      systemClock{},
+		newLimiter: newBucketLimiter,
+		observer:   NopObserver{},
+		conns:      newConnRegistry(),
+		closed:     make(chan struct{}),
+	}
+	bl.limitGroup.init(bl.clock, bl.newLimiter, NewUnlimitedConfig())
+	// Classes and subnets inherit missing connection limits, so their connections are informed about changes.
+	bl.limitGroup.onConnChange = func() {
+		bl.classes.inheritedChanged()
+		bl.ips.inheritedChanged()
+	}
+	bl.classes.onConnChange = bl.ips.inheritedChanged
+	bl.unclassified.setParent(&bl.traffic)
+	bl.classes.traffic = &bl.traffic
+	for _, opt := range opts {
+		opt(bl)
+	}
+
+	return bl
+}
+
+// start loads usage of quotas and a config file, and it starts background goroutines.
+// When it fails, then the listener must not be used.
+func (bl *listener) start() error {
+	if bl.store != nil {
+		usage, err := bl.store.Load()
+		if err != nil {
+			err = fmt.Errorf("bandwidth: failed to load usage of quotas: %w", err)
+			bl.cancel(err)
+			return err
+		}
+		bl.quotas.Restore(usage)
+	}
+
+	now := bl.clock.Now()
+	if bl.schedule != nil {
+		bl.applySchedule(now)
+	}
+
+	var configInfo os.FileInfo
+	if bl.configPath != "" {
+		// The file is checked before it is loaded, so the watcher reloads it when it is changed in the meantime.
+		info, err := os.Stat(bl.configPath)
+		if err != nil {
+			err = fmt.Errorf("bandwidth: failed to read config: %w", err)
+		} else {
+			err = bl.ReloadConfigFile()
+		}
+		if err != nil {
+			bl.cancel(err)
+			return err
+		}
+		configInfo = info
+	}
+
+	// Background goroutines are started when the listener has been initialized, so they do not run after errors.
+	if bl.store != nil {
+		go bl.flushPeriodically()
+	}
+	if bl.schedule != nil {
+		go bl.runSchedule(now)
+	}
+	if bl.configPath != "" {
+		// SIGHUP is subscribed before the listener is returned, so it is never missed.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go bl.watchConfigFile(configInfo, hup)
+	}
+
+	return nil
+}
+
+// GetLimits returns global and connection limits for writing.
+// It is kept for callers which use SetLimits, so both directions have the same limits.
+// Use GetReadLimits and GetWriteLimits when limits are set separately per direction.
+func (bl *listener) GetLimits() (Config, Config) {
+	return bl.GetWriteLimits()
+}
+
+// GetReadLimits returns global and connection limits for reading.
+func (bl *listener) GetReadLimits() (Config, Config) {
+	return bl.getLimits(readDirection)
+}
+
+// GetWriteLimits returns global and connection limits for writing.
+func (bl *listener) GetWriteLimits() (Config, Config) {
+	return bl.getLimits(writeDirection)
+}
+
+// SetLimits sets global and connection limits for both reading and writing.
+// Reading and writing have independent limiters, so they do not block each other.
+func (bl *listener) SetLimits(globalCfg, connCfg Config) {
+	bl.setLimits(globalCfg, connCfg, bothDirections...)
+}
+
+// SetReadLimits sets global and connection limits for reading.
+func (bl *listener) SetReadLimits(globalCfg, connCfg Config) {
+	bl.setLimits(globalCfg, connCfg, readDirection)
+}
+
+// SetWriteLimits sets global and connection limits for writing.
+func (bl *listener) SetWriteLimits(globalCfg, connCfg Config) {
+	bl.setLimits(globalCfg, connCfg, writeDirection)
+}
+
+// setLimits sets global and connection limits for given directions, and notifies the observer when they change.
+func (bl *listener) setLimits(globalCfg, connCfg Config, dirs ...direction) {
+	bl.limitsMutex.Lock()
+	defer bl.limitsMutex.Unlock()
+
+	old := bl.limits()
+	// Connection limit of the listener is not inherited from anywhere, so it is unlimited when it is missing.
+	bl.limitGroup.setLimits(globalCfg, orUnlimited(connCfg), dirs...)
+	if current := bl.limits(); current != old {
+		bl.observer.OnLimitsChanged(old, current)
+	}
+}
+
+// limits returns global and connection limits for both directions.
+func (bl *listener) limits() Limits {
+	var l Limits
+	l.GlobalRead, l.ConnRead = bl.getLimits(readDirection)
+	l.GlobalWrite, l.ConnWrite = bl.getLimits(writeDirection)
+
+	return l
+}
+
+// SetSourceLimit sets limit for reading and writing, which is shared by all connections from the same source.
+// It has effect only when the listener is created with WithSourceLimits option.
+func (bl *listener) SetSourceLimit(cfg Config) {
+	bl.sources.SetConfig(cfg, bothDirections...)
+}
+
+// SetSourceReadLimit sets limit for reading, which is shared by all connections from the same source.
+// It has effect only when the listener is created with WithSourceLimits option.
+func (bl *listener) SetSourceReadLimit(cfg Config) {
+	bl.sources.SetConfig(cfg, readDirection)
+}
+
+// SetSourceWriteLimit sets limit for writing, which is shared by all connections from the same source.
+// It has effect only when the listener is created with WithSourceLimits option.
+func (bl *listener) SetSourceWriteLimit(cfg Config) {
+	bl.sources.SetConfig(cfg, writeDirection)
+}
+
+// SourceLimits returns limits for reading and writing, which are shared by all connections from the same source.
+func (bl *listener) SourceLimits() (Config, Config) {
+	cfg := bl.sources.Config()
+
+	return cfg[readDirection], cfg[writeDirection]
+}
+
+// SetClassLimits sets class and connection limits of a traffic class for both reading and writing.
+// Class limit is shared by all connections of the class. Connection limit is used
+// by connections of the class instead of listener's connection limit. Zero connection Config is a missing limit,
+// so connections of the class follow listener's connection limit, like in a class which has not been set.
+// It has effect only when the listener is created with WithClassifier option.
+func (bl *listener) SetClassLimits(name string, classCfg, connCfg Config) {
+	bl.classes.Get(name).setLimits(classCfg, connCfg, bothDirections...)
+}
+
+// SetClassReadLimits sets class and connection limits of a traffic class for reading.
+func (bl *listener) SetClassReadLimits(name string, classCfg, connCfg Config) {
+	bl.classes.Get(name).setLimits(classCfg, connCfg, readDirection)
+}
+
+// SetClassWriteLimits sets class and connection limits of a traffic class for writing.
+func (bl *listener) SetClassWriteLimits(name string, classCfg, connCfg Config) {
+	bl.classes.Get(name).setLimits(classCfg, connCfg, writeDirection)
+}
+
+// GetClassReadLimits returns class and connection limits of a traffic class for reading.
+// Connection limit is zero Config when it is inherited from the listener.
+func (bl *listener) GetClassReadLimits(name string) (Config, Config) {
+	return bl.classes.Get(name).getLimits(readDirection)
+}
+
+// GetClassWriteLimits returns class and connection limits of a traffic class for writing.
+// Connection limit is zero Config when it is inherited from the listener.
+func (bl *listener) GetClassWriteLimits(name string) (Config, Config) {
+	return bl.classes.Get(name).getLimits(writeDirection)
+}
+
+// SetClassBypassGlobal sets whether connections of a traffic class are limited only by class limits
+// instead of global limits. It has effect on connections accepted afterwards.
+func (bl *listener) SetClassBypassGlobal(name string, bypass bool) {
+	bl.classes.Get(name).setBypassGlobal(bypass)
+}
+
+// SetIPLimits sets limits of connections from a given IP address or subnet for both reading and writing.
+// Subnet limit is shared by all connections from the subnet. Connection limit is used by connections
+// from the subnet instead of listener's or class's connection limit. Zero connection Config is a missing limit,
+// so connections from the subnet follow class's or listener's connection limit. When subnets overlap, then
+// the most specific one is used. Single IP address can be given as a subnet with all bits, e.g. /32.
+func (bl *listener) SetIPLimits(prefix netip.Prefix, ipCfg, connCfg Config) {
+	bl.ips.Get(prefix).setLimits(ipCfg, connCfg, bothDirections...)
+}
+
+// GetIPReadLimits returns subnet and connection limits of a given IP address or subnet for reading.
+// Subnet limit is unlimited when the subnet does not have limits, and connection limit is zero Config when it is inherited.
+func (bl *listener) GetIPReadLimits(prefix netip.Prefix) (Config, Config) {
+	return bl.getIPLimits(prefix, readDirection)
+}
+
+// GetIPWriteLimits returns subnet and connection limits of a given IP address or subnet for writing.
+// Subnet limit is unlimited when the subnet does not have limits, and connection limit is zero Config when it is inherited.
+func (bl *listener) GetIPWriteLimits(prefix netip.Prefix) (Config, Config) {
+	return bl.getIPLimits(prefix, writeDirection)
+}
+
+// getIPLimits returns subnet and connection limits of a given IP address or subnet for a given direction.
+func (bl *listener) getIPLimits(prefix netip.Prefix, d direction) (Config, Config) {
+	g, ok := bl.ips.Lookup(prefix)
+	if !ok {
+		return NewUnlimitedConfig(), Config{}
 	}
+
+	return g.getLimits(d)
+}
+
+// RemoveIPLimits removes limits of a given IP address or subnet. It has effect on connections accepted afterwards,
+// and existing connections from the subnet keep its limits.
+func (bl *listener) RemoveIPLimits(prefix netip.Prefix) {
+	bl.ips.Remove(prefix)
+}
+
+// SetHTBNode adds or changes a node of hierarchical token bucket (HTB) for both reading and writing.
+// Each node has a guaranteed (assured) rate and a ceiling. When a node has used its guaranteed rate,
+// then it can borrow idle capacity from its ancestors up to its ceiling. Each node gets its guaranteed rate
+// even when other nodes are busy, so guaranteed rates and bursts of children should not exceed their parent's.
+// Empty parent means that the node is at the top of the tree. Connections are attached to a node with the same name as their traffic class,
+// so it has effect only when the listener is created with WithClassifier option.
+func (bl *listener) SetHTBNode(name, parent string, assured, ceil Config) error {
+	return bl.htb.Set(name, parent, assured, ceil, bothDirections...)
+}
+
+// SetHTBReadNode adds or changes a node of hierarchical token bucket for reading.
+func (bl *listener) SetHTBReadNode(name, parent string, assured, ceil Config) error {
+	return bl.htb.Set(name, parent, assured, ceil, readDirection)
+}
+
+// SetHTBWriteNode adds or changes a node of hierarchical token bucket for writing.
+func (bl *listener) SetHTBWriteNode(name, parent string, assured, ceil Config) error {
+	return bl.htb.Set(name, parent, assured, ceil, writeDirection)
+}
+
+// RemoveHTBNode removes a node of hierarchical token bucket, which does not have children.
+func (bl *listener) RemoveHTBNode(name string) error {
+	return bl.htb.Remove(name)
 }
 
-// GetConnCfg returns connection config.
-// It also returns channel, which will be closed when configuration is changed.
-func (bl *listener) GetConnCfg() (<-chan struct{}, config) {
-	bl.mutex.RLock()
-	defer bl.mutex.RUnlock()
+// SetQuota sets a byte quota for each key of connections, e.g. 10 GiB per day for each client.
+// It has effect only when the listener is created with WithQuotas option.
+// Usage of existing keys is kept.
+func (bl *listener) SetQuota(q Quota) {
+	bl.quotas.SetConfig(q)
+}
+
+// Quota returns a byte quota for each key of connections.
+func (bl *listener) Quota() Quota {
+	return bl.quotas.Config()
+}
 
-	return bl.c, bl.limitCfgConn
+// QuotaUsed returns a number of bytes used by connections with a given key in the current window.
+func (bl *listener) QuotaUsed(key string) int64 {
+	return bl.quotas.Used(key)
 }
 
-// GetLimits returns global and connection limits.
-func (bl *listener) GetLimits() (config, config) {
-	bl.mutex.RLock()
-	defer bl.mutex.RUnlock()
+// FlushUsage saves usage of quotas into the store.
+// It is called periodically and when the listener is closed, so it is rarely needed.
+func (bl *listener) FlushUsage() error {
+	if bl.store == nil {
+		return nil
+	}
 
-	return bl.limitCfgGlobal, bl.limitCfgConn
+	return bl.store.Save(bl.quotas.Usage())
 }
 
-// SetLimits sets global and connection limits for writing and reading.
-func (bl *listener) SetLimits(globalCfg, connCfg config) {
-	bl.mutex.Lock()
-	defer bl.mutex.Unlock()
+// flushPeriodically saves usage of quotas until the listener is closed.
+// When the listener's context is done, e.g. on SIGTERM, then usage is saved for the last time.
+func (bl *listener) flushPeriodically() {
+	for {
+		var tick <-chan time.Time
+		var timer Timer
+		if bl.flushInterval > 0 {
+			timer = bl.clock.NewTimer(bl.flushInterval)
+			tick = timer.C()
+		}
+
+		select {
+		case <-tick:
+			// Error is not fatal, and usage is saved again next time.
+			_ = bl.FlushUsage()
+			continue
+		case <-bl.ctx.Done():
+			_ = bl.FlushUsage()
+		case <-bl.closed:
+			// Close saves usage itself, so it can return an error.
+		}
 
-	bl.limitCfgGlobal = globalCfg
-	bl.sharedLimiter.SetLimit(globalCfg.limit)
-	bl.sharedLimiter.SetBurst(globalCfg.burst)
+		if timer != nil {
+			timer.Stop()
+		}
 
-	if bl.limitCfgConn.IsTheSame(connCfg) {
-		// Nothing changes for connections.
 		return
 	}
+}
+
+// ApplyFileConfig sets limits described by a given config. Only limits which are different from the last
+// applied config are set, and limits which are missing in the config are reset to unlimited,
+// apart from connection limits of classes and subnets, which are inherited.
+// When the first config is applied, then all its limits are set, so they replace limits set manually.
+// Invalid config is rejected as a whole, so no limit is changed. The config must not be modified afterwards.
+func (bl *listener) ApplyFileConfig(fc *FileConfig) error {
+	if err := fc.Validate(); err != nil {
+		return err
+	}
+
+	bl.configMutex.Lock()
+	defer bl.configMutex.Unlock()
+
+	old := bl.fileCfg
+	first := old == nil
+	if first {
+		old = &FileConfig{}
+	}
+	changed := func(oldCfg, newCfg Config) bool {
+		return first || !orUnlimited(oldCfg).IsTheSame(orUnlimited(newCfg))
+	}
+	// Missing connection limits of classes and subnets are inherited, so they are not the same as unlimited.
+	connChanged := func(oldCfg, newCfg Config) bool {
+		return first || !oldCfg.IsTheSame(newCfg)
+	}
+
+	if changed(old.Global, fc.Global) || changed(old.Conn, fc.Conn) {
+		bl.SetLimits(orUnlimited(fc.Global), orUnlimited(fc.Conn))
+	}
+	if changed(old.Source, fc.Source) {
+		bl.SetSourceLimit(orUnlimited(fc.Source))
+	}
+
+	for name, cl := range fc.Classes {
+		oldClass := old.Classes[name]
+		if changed(oldClass.Limit, cl.Limit) || connChanged(oldClass.Conn, cl.Conn) {
+			bl.SetClassLimits(name, orUnlimited(cl.Limit), cl.Conn)
+		}
+		if first || oldClass.BypassGlobal != cl.BypassGlobal {
+			bl.SetClassBypassGlobal(name, cl.BypassGlobal)
+		}
+	}
+	for name := range old.Classes {
+		if _, ok := fc.Classes[name]; !ok {
+			bl.SetClassLimits(name, NewUnlimitedConfig(), Config{})
+			bl.SetClassBypassGlobal(name, false)
+		}
+	}
+
+	oldIPs, newIPs := old.ipPrefixes(), fc.ipPrefixes()
+	for prefix, ip := range newIPs {
+		oldIP := oldIPs[prefix]
+		if changed(oldIP.Limit, ip.Limit) || connChanged(oldIP.Conn, ip.Conn) {
+			bl.SetIPLimits(prefix, orUnlimited(ip.Limit), ip.Conn)
+		}
+	}
+	for prefix := range oldIPs {
+		if _, ok := newIPs[prefix]; !ok {
+			bl.RemoveIPLimits(prefix)
+		}
+	}
+
+	bl.fileCfg = fc
+
+	return nil
+}
+
+// ReloadConfigFile loads the config file and applies it. When the file is invalid,
+// then it returns an error and limits are not changed. It has effect only when the listener
+// is created with WithConfigFile option, and it is called automatically on SIGHUP and changes of the file.
+func (bl *listener) ReloadConfigFile() error {
+	if bl.configPath == "" {
+		return errors.New("bandwidth: listener does not have config file")
+	}
+
+	fc, err := LoadFileConfig(bl.configPath)
+	if err != nil {
+		return err
+	}
+
+	return bl.ApplyFileConfig(fc)
+}
+
+// watchConfigFile reloads the config file on SIGHUP and when its modification time or size changes,
+// until the listener is closed. Errors are reported to configErrors.
+func (bl *listener) watchConfigFile(last os.FileInfo, hup chan os.Signal) {
+	defer signal.Stop(hup)
+
+	for {
+		var tick <-chan time.Time
+		var timer Timer
+		if bl.configPollInterval > 0 {
+			timer = bl.clock.NewTimer(bl.configPollInterval)
+			tick = timer.C()
+		}
+
+		reload := false
+		select {
+		case <-hup:
+			reload = true
+		case <-tick:
+			info, err := os.Stat(bl.configPath)
+			if err != nil {
+				bl.reportConfigError(err)
+				break
+			}
+			reload = !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size()
+			last = info
+		case <-bl.ctx.Done():
+		case <-bl.closed:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if bl.ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-bl.closed:
+			return
+		default:
+		}
+
+		if reload {
+			bl.reportConfigError(bl.ReloadConfigFile())
+		}
+	}
+}
+
+// reportConfigError calls configErrors with a given error, when both of them are not nil.
+func (bl *listener) reportConfigError(err error) {
+	if err != nil && bl.configErrors != nil {
+		bl.configErrors(err)
+	}
+}
 
-	// Inform all existing connections about new configuration by closing channel.
-	// Create a new channel which will be closed when config changes next time, so
-	// connection will be informed once again.
-	close(bl.c)
-	bl.c = make(chan struct{})
+// applySchedule sets limits of the schedule at a given time.
+func (bl *listener) applySchedule(now time.Time) {
+	globalCfg, connCfg := bl.schedule.Limits(now)
+	bl.SetLimits(globalCfg, connCfg)
+}
+
+// runSchedule sets limits of the schedule whenever they change, until the listener is closed.
+// It wakes up when limits can change, and when a rule is added to the schedule.
+// Limits set manually are kept until limits of the schedule change.
+func (bl *listener) runSchedule(now time.Time) {
+	globalCfg, connCfg := bl.schedule.Limits(now)
+	for {
+		// Changes are taken before the next time, so a rule added in between is not missed.
+		changed := bl.schedule.changes()
+		timer := bl.clock.NewTimer(bl.schedule.Next(now).Sub(now))
+		select {
+		case <-timer.C():
+		case <-changed:
+			timer.Stop()
+		case <-bl.ctx.Done():
+			timer.Stop()
+			return
+		case <-bl.closed:
+			timer.Stop()
+			return
+		}
 
-	bl.limitCfgConn = connCfg
+		now = bl.clock.Now()
+		newGlobalCfg, newConnCfg := bl.schedule.Limits(now)
+		if newGlobalCfg != globalCfg || newConnCfg != connCfg {
+			globalCfg, connCfg = newGlobalCfg, newConnCfg
+			bl.SetLimits(globalCfg, connCfg)
+		}
+	}
 }
 
-// WaitN waits until global limiter allows for operating on n bytes.
-func (bl *listener) WaitN(ctx context.Context, n int) error {
-	return bl.sharedLimiter.WaitN(ctx, n)
+// setClock makes the listener and all its limiters use a given clock.
+func (bl *listener) setClock(clock Clock) {
+	bl.clock = clock
+	bl.limitGroup.clock = clock
+	bl.sources.clock = clock
+	bl.classes.clock = clock
+	bl.ips.clock = clock
+	bl.htb.clock = clock
+	bl.quotas.clock = clock
+	for _, d := range bothDirections {
+		if bl.fair[d] != nil {
+			bl.fair[d].clock = clock
+		}
+	}
+}
+
+// setLimiterFactory makes the listener create all its limiters by a given factory.
+// Global limiters have been already created, so they are replaced by new ones with the same configs.
+func (bl *listener) setLimiterFactory(factory LimiterFactory) {
+	newLimiter := func(c Config) Limiter {
+		return factory(orUnlimited(c))
+	}
+	bl.newLimiter = newLimiter
+	bl.sources.newLimiter = newLimiter
+	bl.classes.newLimiter = newLimiter
+	bl.ips.newLimiter = newLimiter
+	bl.htb.newLimiter = newLimiter
+	bl.quotas.newLimiter = newLimiter
+	for _, d := range bothDirections {
+		bl.sharedLimiter[d] = newLimiter(bl.limitCfgShared[d])
+		if bl.fair[d] != nil {
+			bl.fair[d].limiter = bl.sharedLimiter[d]
+		}
+	}
 }
 
 // Accept returns accepted bandwidth connection.
@@ -94,16 +643,137 @@ func (bl *listener) Accept() (net.Conn, error) {
 		return conn, err
 	}
 
-	// Here mutex does not block connection's writers.
-	bl.mutex.RLock()
-	defer bl.mutex.RUnlock()
+	// Classified connection gets connection limits from its class instead of the listener.
+	// Connection from a subnet with limits gets connection limits from the subnet, even when it is classified.
+	// Missing connection limits of a subnet or a class are inherited from the next group.
+	controller := limitChain{&bl.limitGroup}
+	className, cl, classified := bl.classes.Classify(conn)
+	if classified {
+		controller = append(limitChain{&cl.limitGroup}, controller...)
+	}
+	ipGroup, ipMatched := bl.ips.Match(conn)
+	if ipMatched {
+		controller = append(limitChain{ipGroup}, controller...)
+	}
+	c, connCfg := controller.GetConnCfg()
 
-	return &connection{
+	// Each connection has its own context, so closing one connection does not affect others.
+	ctx, cancel := context.WithCancelCause(bl.ctx)
+	bc := &connection{
 		Conn:       conn,
-		ctx:        bl.ctx,
-		limiter:    bl.limitCfgConn.NewRateLimiter(),
-		controller: bl,
+		ctx:        ctx,
+		cancel:     cancel,
+		controller: controller,
+		clock:      bl.clock,
+		observer:   bl.observer,
+		acceptedAt: bl.clock.Now(),
+		class:      className,
 		// pass read only channel, which will be closed when config is changed.
-		c: bl.c,
-	}, nil
+		c: c,
+	}
+	if classified {
+		bc.releases = append(bc.releases, cl.traffic.attach(bc))
+	} else {
+		bc.releases = append(bc.releases, bl.unclassified.attach(bc))
+	}
+	sourceLimiter, release, ok := bl.sources.Acquire(conn)
+	if ok {
+		bc.releases = append(bc.releases, release)
+	}
+	if counter, release, hasQuota := bl.quotas.Acquire(conn); hasQuota {
+		bc.quota = counter
+		bc.releases = append(bc.releases, release)
+	}
+	for _, d := range bothDirections {
+		bc.limiter[d] = bl.newLimiter(connCfg[d])
+		if ok {
+			bc.sharedLimiters[d] = append(bc.sharedLimiters[d], waitingLimiter{sourceLimiter[d]})
+		}
+		if ipMatched {
+			bc.sharedLimiters[d] = append(bc.sharedLimiters[d], waitingLimiter{ipGroup.sharedLimiter[d]})
+		}
+		if classified {
+			bc.sharedLimiters[d] = append(bc.sharedLimiters[d],
+				waitingLimiter{cl.sharedLimiter[d]}, bl.htb.Limiter(className, d))
+		}
+		if !classified || !cl.BypassGlobal() {
+			bc.sharedLimiters[d] = append(bc.sharedLimiters[d], bl.globalLimiter(bc, d))
+		}
+	}
+	if bl.prioritizer != nil {
+		bc.SetPriority(bl.prioritizer(conn))
+	}
+	bc.releases = append(bc.releases, bl.conns.Add(bc))
+	bl.observer.OnAccept(bc)
+
+	return bc, nil
+}
+
+// Stats returns a snapshot of traffic statistics of all accepted connections.
+func (bl *listener) Stats() ListenerStats {
+	return bl.traffic.Snapshot(bl.clock.Now())
+}
+
+// Connections returns descriptions of all accepted connections which have not been closed yet, ordered by their IDs.
+func (bl *listener) Connections() []ConnInfo {
+	conns := bl.conns.All()
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, bc := range conns {
+		infos = append(infos, bc.info())
+	}
+
+	return infos
+}
+
+// Disconnect closes a connection with a given ID, so all its goroutines which wait for limiters are interrupted.
+// It returns an error when there is no open connection with the ID.
+func (bl *listener) Disconnect(id uint64) error {
+	bc, ok := bl.conns.Get(id)
+	if !ok {
+		return fmt.Errorf("bandwidth: connection %d does not exist", id)
+	}
+
+	return bc.Close()
+}
+
+// SetConnLimit overrides limits for reading and writing of a connection with a given ID, like Conn.SetLimit.
+// It returns an error when there is no open connection with the ID.
+func (bl *listener) SetConnLimit(id uint64, cfg Config) error {
+	bc, ok := bl.conns.Get(id)
+	if !ok {
+		return fmt.Errorf("bandwidth: connection %d does not exist", id)
+	}
+	bc.SetLimit(cfg)
+
+	return nil
+}
+
+// globalLimiter returns a limiter of a new connection, which shares global limit with other connections.
+func (bl *listener) globalLimiter(bc *connection, d direction) limiter {
+	if bl.fair[d] != nil {
+		bc.flows[d] = bl.fair[d].Flow()
+		return bc.flows[d]
+	}
+
+	return waitingLimiter{bl.sharedLimiter[d]}
+}
+
+// Close closes the listener.
+// When the listener is created with WithCloseConnections option, then all accepted connections are interrupted too.
+// When the listener is created with WithStore option, then usage of quotas is saved.
+func (bl *listener) Close() error {
+	bl.closeOnce.Do(func() {
+		close(bl.closed)
+	})
+
+	var flushErr error
+	if bl.store != nil {
+		flushErr = bl.FlushUsage()
+	}
+
+	if bl.closeConns {
+		bl.cancel(net.ErrClosed)
+	}
+
+	return errors.Join(flushErr, bl.Listener.Close())
 }
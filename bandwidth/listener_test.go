@@ -3,8 +3,15 @@ package bandwidth
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -43,14 +50,17 @@ const (
 
 type OperationFunc func() int
 
-// TestReadAndWriteAtTheSameTime tests if write and read block each other because of limiter.
+// TestReadAndWriteAtTheSameTime tests if write and read do not block each other,
+// because each direction has its own limiter.
 func TestReadAndWriteAtTheSameTime(tOuter *testing.T) {
 	tOuter.Run("global limiting with simultaneous read and writes", func(t *testing.T) {
 		t.Parallel()
 		var limit rate.Limit = 10
-		expectedBytes := 40
+		// Read and write have independent limiters, so each of them should process 40 bytes in 3 seconds.
+		expectedBytes := 80
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
 		bl.SetLimits(NewConfig(limit), connLimit)
 		conn := acceptT(t, bl)
@@ -79,15 +89,17 @@ func TestReadAndWriteAtTheSameTime(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*4), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*4), op)
 	})
 
 	tOuter.Run("connection limiting with simultaneous read and writes", func(t *testing.T) {
 		t.Parallel()
 		var limit rate.Limit = 10
-		expectedBytes := 40
+		// Read and write have independent limiters, so each of them should process 40 bytes in 3 seconds.
+		expectedBytes := 80
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		bl.SetLimits(globalLimit, NewConfig(limit))
 		conn := acceptT(t, bl)
@@ -116,16 +128,12 @@ func TestReadAndWriteAtTheSameTime(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*4), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*4), op)
 	})
 }
 
 // TestLongDuration runs long tests and check if rate is expected.
 func TestLongDuration(tOuter *testing.T) {
-	if testing.Short() {
-		tOuter.Skip("testing argument -short is turned on")
-	}
-
 	// Setting for all below sub-tests.
 	expectedDuration := time.Second * 30
 	var rateLimit rate.Limit = 1000
@@ -134,117 +142,97 @@ func TestLongDuration(tOuter *testing.T) {
 	tOuter.Run(testName, func(t *testing.T) {
 		t.Parallel()
 
-		ctx, cancel := context.WithTimeout(context.Background(), expectedDuration)
-		defer cancel()
-
-		bl := NewListener(ctx, mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
 		bl.SetLimits(NewConfig(rateLimit), connLimit)
 		conn := acceptT(t, bl)
 		b := newSlice(int(rateLimit))
 
+		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
 		var op OperationFunc = func() int {
-			var counter, n int
-			var err error
-
-			for err == nil {
-				n, err = conn.Write(b)
-				counter += n
+			var counter int
+			for counter < expectedBytes {
+				counter += writeT(t, conn, b)
 			}
 
 			return counter
 		}
 
-		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
-		checkRate(t, expectedBytes, getRealSeconds(expectedDuration), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(expectedDuration), op)
 	})
 
 	testName = fmt.Sprintf("check connection read rate after %s", expectedDuration.String())
 	tOuter.Run(testName, func(t *testing.T) {
 		t.Parallel()
 
-		ctx, cancel := context.WithTimeout(context.Background(), expectedDuration)
-		defer cancel()
-
-		bl := NewListener(ctx, mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		bl.SetLimits(globalLimit, NewConfig(rateLimit))
 		conn := acceptT(t, bl)
 		b := newSlice(int(rateLimit))
 
+		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
 		var op OperationFunc = func() int {
-			var counter, n int
-			var err error
-
-			for err == nil {
-				n, err = conn.Read(b)
-				counter += n
+			var counter int
+			for counter < expectedBytes {
+				counter += readT(t, conn, b)
 			}
 
 			return counter
 		}
 
-		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
-		checkRate(t, expectedBytes, getRealSeconds(expectedDuration), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(expectedDuration), op)
 	})
 
 	testName = fmt.Sprintf("check global write rate after %s", expectedDuration.String())
 	tOuter.Run(testName, func(t *testing.T) {
 		t.Parallel()
 
-		ctx, cancel := context.WithTimeout(context.Background(), expectedDuration)
-		defer cancel()
-
-		bl := NewListener(ctx, mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
 		bl.SetLimits(NewConfig(rateLimit), connLimit)
 		conn := acceptT(t, bl)
 		b := newSlice(int(rateLimit))
 
+		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
 		var op OperationFunc = func() int {
-			var counter, n int
-			var err error
-
-			for err == nil {
-				n, err = conn.Write(b)
-				counter += n
+			var counter int
+			for counter < expectedBytes {
+				counter += writeT(t, conn, b)
 			}
 
 			return counter
 		}
 
-		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
-		checkRate(t, expectedBytes, getRealSeconds(expectedDuration), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(expectedDuration), op)
 	})
 
 	testName = fmt.Sprintf("check global read rate after %s", expectedDuration.String())
 	tOuter.Run(testName, func(t *testing.T) {
 		t.Parallel()
 
-		ctx, cancel := context.WithTimeout(context.Background(), expectedDuration)
-		defer cancel()
-
-		bl := NewListener(ctx, mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		bl.SetLimits(globalLimit, NewConfig(rateLimit))
 
 		conn := acceptT(t, bl)
 		b := newSlice(int(rateLimit))
 
+		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
 		var op OperationFunc = func() int {
-			var counter, n int
-			var err error
-
-			for err == nil {
-				n, err = conn.Read(b)
-				counter += n
+			var counter int
+			for counter < expectedBytes {
+				counter += readT(t, conn, b)
 			}
 
 			return counter
 		}
 
-		expectedBytes := int(expectedDuration.Seconds()) * int(rateLimit)
-		checkRate(t, expectedBytes, getRealSeconds(expectedDuration), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(expectedDuration), op)
 	})
 }
 
@@ -255,7 +243,8 @@ func TestOneConnectionManyClients(tOuter *testing.T) {
 		var limit rate.Limit = 10
 		expectedBytes := 40
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
 		bl.SetLimits(NewConfig(limit), connLimit)
 		conn := acceptT(t, bl)
@@ -284,14 +273,15 @@ func TestOneConnectionManyClients(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*4), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*4), op)
 	})
 	tOuter.Run("1 connection with two simultaneous reads", func(t *testing.T) {
 		t.Parallel()
 		var limit rate.Limit = 10
 		expectedBytes := 40
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		bl.SetLimits(globalLimit, NewConfig(limit))
 		conn := acceptT(t, bl)
@@ -320,7 +310,7 @@ func TestOneConnectionManyClients(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*4), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*4), op)
 	})
 }
 
@@ -331,7 +321,8 @@ func TestTwoConnections(tOuter *testing.T) {
 		var rateGlobal rate.Limit = 10
 		expectedBytes1, expectedBytes2 := 50, 40
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
 		bl.SetLimits(NewConfig(rateGlobal), connLimit)
 		conn1 := acceptT(t, bl)
@@ -360,7 +351,7 @@ func TestTwoConnections(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*9), op)
+		checkRate(t, clock, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*9), op)
 	})
 
 	tOuter.Run("2 connections compete for read global rate", func(t *testing.T) {
@@ -368,7 +359,8 @@ func TestTwoConnections(tOuter *testing.T) {
 		var rateGlobal rate.Limit = 10
 		expectedBytes1, expectedBytes2 := 50, 40
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
 		bl.SetLimits(NewConfig(rateGlobal), connLimit)
 		conn1 := acceptT(t, bl)
@@ -397,7 +389,7 @@ func TestTwoConnections(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*9), op)
+		checkRate(t, clock, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*9), op)
 	})
 
 	tOuter.Run("2 connections don't compete for write connection rate", func(t *testing.T) {
@@ -405,7 +397,8 @@ func TestTwoConnections(tOuter *testing.T) {
 		var rateConn rate.Limit = 10
 		expectedBytes1, expectedBytes2 := 50, 40
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		bl.SetLimits(globalLimit, NewConfig(rateConn))
 		conn1 := acceptT(t, bl)
@@ -434,7 +427,7 @@ func TestTwoConnections(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*5), op)
+		checkRate(t, clock, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*5), op)
 	})
 
 	tOuter.Run("2 connections don't compete for read connection rate", func(t *testing.T) {
@@ -442,7 +435,8 @@ func TestTwoConnections(tOuter *testing.T) {
 		var rateConn rate.Limit = 10
 		expectedBytes1, expectedBytes2 := 50, 40
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		bl.SetLimits(globalLimit, NewConfig(rateConn))
 		conn1 := acceptT(t, bl)
@@ -471,7 +465,7 @@ func TestTwoConnections(tOuter *testing.T) {
 			return counter1 + counter2
 		}
 
-		checkRate(t, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*5), op)
+		checkRate(t, clock, expectedBytes1+expectedBytes2, getRealSeconds(time.Second*5), op)
 	})
 }
 
@@ -493,11 +487,119 @@ func TestCheckConfigs(t *testing.T) {
 	assert.Equal(t, NewConfig(100, 100), connLimit)
 }
 
+func TestCheckConfigsPerDirection(t *testing.T) {
+	ml := mockListener{}
+	bl := NewListener(context.Background(), ml)
+	bl.SetReadLimits(NewConfig(100), NewConfig(50))
+	bl.SetWriteLimits(NewConfig(200), NewConfig(20))
+
+	globalLimit, connLimit := bl.GetReadLimits()
+	assert.Equal(t, NewConfig(100), globalLimit)
+	assert.Equal(t, NewConfig(50), connLimit)
+
+	globalLimit, connLimit = bl.GetWriteLimits()
+	assert.Equal(t, NewConfig(200), globalLimit)
+	assert.Equal(t, NewConfig(20), connLimit)
+
+	// SetLimits overrides both directions.
+	bl.SetLimits(NewConfig(10), NewConfig(5))
+	for _, getLimits := range []func() (Config, Config){bl.GetReadLimits, bl.GetWriteLimits} {
+		globalLimit, connLimit = getLimits()
+		assert.Equal(t, NewConfig(10), globalLimit)
+		assert.Equal(t, NewConfig(5), connLimit)
+	}
+}
+
+// TestZeroConfig tests whether zero Config is unlimited, like a missing limit.
+func TestZeroConfig(t *testing.T) {
+	ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000"}}
+	bl := NewListener(context.Background(), ml, WithSourceLimits(24, 64))
+	bl.SetLimits(Config{}, Config{})
+	bl.SetSourceLimit(Config{})
+	require.NoError(t, bl.SetHTBNode("root", "", NewConfig(10), Config{}))
+
+	globalLimit, connLimit := bl.GetLimits()
+	assert.Equal(t, NewUnlimitedConfig(), globalLimit)
+	assert.Equal(t, NewUnlimitedConfig(), connLimit)
+	sourceLimit, _ := bl.SourceLimits()
+	assert.Equal(t, NewUnlimitedConfig(), sourceLimit)
+
+	conn := acceptT(t, bl)
+	checkQuickOperation(t, 200, func() int {
+		return writeT(t, conn, newSlice(100)) + readT(t, conn, newSlice(100))
+	})
+
+	conn = acceptT(t, bl)
+	conn.(Conn).SetLimit(Config{})
+	readCfg, writeCfg := conn.(Conn).Limits()
+	assert.Equal(t, NewUnlimitedConfig(), readCfg)
+	assert.Equal(t, NewUnlimitedConfig(), writeCfg)
+	checkQuickOperation(t, 100, func() int {
+		return writeT(t, conn, newSlice(100))
+	})
+}
+
+// TestSetLimitsPerDirection tests whether limits for one direction do not affect the other direction.
+func TestSetLimitsPerDirection(tOuter *testing.T) {
+	tOuter.Run("write is not limited by read limits", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetReadLimits(NewConfig(10), NewConfig(10))
+		conn := acceptT(t, bl)
+		b := newSlice(100)
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn, b) + writeT(t, conn, b)
+		}
+
+		checkQuickOperation(t, 200, op)
+	})
+
+	tOuter.Run("read is not limited by write limits", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetWriteLimits(NewConfig(10), NewConfig(10))
+		conn := acceptT(t, bl)
+		b := newSlice(100)
+
+		var op OperationFunc = func() int {
+			return readT(t, conn, b) + readT(t, conn, b)
+		}
+
+		checkQuickOperation(t, 200, op)
+	})
+
+	tOuter.Run("read 30 bytes in 2 seconds with read connection limit", func(t *testing.T) {
+		t.Parallel()
+		var limit rate.Limit = 10
+		expectedBytes := 30
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		globalLimit, _ := bl.GetReadLimits()
+		bl.SetReadLimits(globalLimit, NewConfig(limit))
+		conn := acceptT(t, bl)
+		b := newSlice(int(limit))
+
+		var op OperationFunc = func() int {
+			counter := 0
+			for counter != expectedBytes {
+				counter += readT(t, conn, b)
+			}
+
+			return counter
+		}
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*3), op)
+	})
+}
+
 // TestSetLimitsPerConnection tests simple connection rate limiter cases.
 func TestSetLimitsPerConnection(tOuter *testing.T) {
 	tOuter.Run("write 20 bytes in 2 seconds", func(t *testing.T) {
 		t.Parallel()
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, connLimit := bl.GetLimits()
 		// Set rate 10 B/s.
 		expectedBytes := 20
@@ -519,12 +621,13 @@ func TestSetLimitsPerConnection(tOuter *testing.T) {
 			return counter
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*2), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*2), op)
 	})
 
 	tOuter.Run("read 20 bytes in 2 seconds", func(t *testing.T) {
 		t.Parallel()
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, connLimit := bl.GetLimits()
 		// Set rate 10 B/s.
 		expectedBytes := 20
@@ -546,7 +649,7 @@ func TestSetLimitsPerConnection(tOuter *testing.T) {
 			return counter
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*2), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*2), op)
 	})
 
 	tOuter.Run("write 20 bytes immediately, because burst is enough", func(t *testing.T) {
@@ -592,11 +695,11 @@ func TestSetLimitsPerConnection(tOuter *testing.T) {
 		checkQuickOperation(t, burst, op)
 	})
 
-	tOuter.Run("burst exploded when reading from connection", func(t *testing.T) {
+	tOuter.Run("read is clamped to burst", func(t *testing.T) {
 		t.Parallel()
 		bl := NewListener(context.Background(), mockListener{})
 		globalLimit, connLimit := bl.GetLimits()
-		// Set rate 10 B/s and burst to 20, so it should be able to write 20 bytes immediately.
+		// Set rate 10 B/s and burst to 5, so it should be able to read only 5 bytes at once.
 		rateBps := 10
 		burst := 5
 		connLimit = NewConfig(rate.Limit(rateBps), burst)
@@ -604,8 +707,11 @@ func TestSetLimitsPerConnection(tOuter *testing.T) {
 		conn := acceptT(t, bl)
 		b := newSlice(rateBps)
 
-		_, err := conn.Read(b)
-		require.Error(t, err, "failed to write data into connection")
+		var op OperationFunc = func() int {
+			return readT(t, conn, b)
+		}
+
+		checkQuickOperation(t, burst, op)
 	})
 
 	tOuter.Run("cancel while writing to connection", func(t *testing.T) {
@@ -677,7 +783,8 @@ func TestSetLimitsPerConnection(tOuter *testing.T) {
 func TestSetLimitsGlobal(tOuter *testing.T) {
 	tOuter.Run("write 50 bytes in 5 seconds", func(t *testing.T) {
 		t.Parallel()
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, connLimit := bl.GetLimits()
 		// Set rate 10 B/s.
 		expectedBytes := 50
@@ -699,12 +806,13 @@ func TestSetLimitsGlobal(tOuter *testing.T) {
 			return counter
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*5), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*5), op)
 	})
 
 	tOuter.Run("read 30 bytes in 3 seconds", func(t *testing.T) {
 		t.Parallel()
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, connLimit := bl.GetLimits()
 		// Set rate 10 B/s.
 		expectedBytes := 30
@@ -725,194 +833,1585 @@ func TestSetLimitsGlobal(tOuter *testing.T) {
 			return counter
 		}
 
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*3), op)
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*3), op)
 	})
 }
 
-// TestGetNewConfig tests whether connections are informed about changed config.
-func TestGetNewConfig(tOuter *testing.T) {
-	tOuter.Run("trigger channel when connection configuration is changed", func(t *testing.T) {
+// TestBufferLargerThanBurst tests whether buffers larger than burst are split into burst-sized chunks.
+func TestBufferLargerThanBurst(tOuter *testing.T) {
+	tOuter.Run("write 30 bytes at once with connection burst 10", func(t *testing.T) {
 		t.Parallel()
-		bl := NewListener(context.Background(), mockListener{})
-		globalLimit, connLimnit := NewConfig(10), NewConfig(20)
-		oldChannel, _ := bl.GetConnCfg()
-		bl.SetLimits(globalLimit, connLimnit)
-		newChannel, newConnCfg := bl.GetConnCfg()
-		assert.Equal(t, connLimnit, newConnCfg)
-		closed := false
-		select {
-		case _, ok := <-oldChannel:
-			closed = !ok
-		default:
+		var limit rate.Limit = 10
+		expectedBytes := 30
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		globalLimit, _ := bl.GetLimits()
+		bl.SetLimits(globalLimit, NewConfig(limit))
+		conn := acceptT(t, bl)
+		b := newSlice(expectedBytes)
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn, b)
 		}
-		assert.Equal(t, true, closed, "old channel should have been closed")
 
-		closed = true
-		select {
-		case <-newChannel:
-		default:
-			closed = false
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*3), op)
+	})
+
+	tOuter.Run("write 30 bytes at once with global burst 10", func(t *testing.T) {
+		t.Parallel()
+		var limit rate.Limit = 10
+		expectedBytes := 30
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		_, connLimit := bl.GetLimits()
+		bl.SetLimits(NewConfig(limit), connLimit)
+		conn := acceptT(t, bl)
+		b := newSlice(expectedBytes)
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn, b)
 		}
-		assert.Equal(t, false, closed, "new channel should not have been closed")
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*3), op)
 	})
 
-	tOuter.Run("don't trigger channel when connection configuration is the same", func(t *testing.T) {
+	tOuter.Run("read with 32 KiB buffer is clamped to the lowest burst", func(t *testing.T) {
 		t.Parallel()
 		bl := NewListener(context.Background(), mockListener{})
-		globalLimit, connLimit := bl.GetLimits()
-		// Set the same values, so configuration should not change.
-		bl.SetLimits(globalLimit, connLimit)
-		newChannel, newConnCfg := bl.GetConnCfg()
-		assert.Equal(t, connLimit, newConnCfg)
+		bl.SetLimits(NewConfig(1000), NewConfig(2000))
+		conn := acceptT(t, bl)
+		b := newSlice(32 * 1024)
 
-		closed := true
-		select {
-		case <-newChannel:
-		default:
-			closed = false
+		var op OperationFunc = func() int {
+			return readT(t, conn, b)
 		}
-		assert.Equal(t, false, closed, "new channel should not have been closed")
+
+		checkQuickOperation(t, 1000, op)
 	})
-}
 
-// TestChangeLimits changes limits on the fly.
-func TestChangeLimits(tOuter *testing.T) {
-	tOuter.Run("write 50 bytes in 8 seconds using 2 different global rates", func(t *testing.T) {
+	tOuter.Run("empty buffer", func(t *testing.T) {
 		t.Parallel()
-		var rate1, rate2 rate.Limit = 10, 5
-		expectedBytes := 50
-
 		bl := NewListener(context.Background(), mockListener{})
-		_, connLimit := bl.GetLimits()
-		bl.SetLimits(NewConfig(rate1), connLimit)
+		bl.SetLimits(NewConfig(10), NewConfig(10))
 		conn := acceptT(t, bl)
-		b := newSlice(int(rate1))
 
 		var op OperationFunc = func() int {
-			counter := 0
-			i := 0
-			for counter != expectedBytes {
-				counter += writeT(t, conn, b)
-				if i == 1 {
-					// Change rate.
-					bl.SetLimits(NewConfig(rate2), connLimit)
-					b = newSlice(int(rate2))
-				}
-				i++
-			}
-
-			return counter
+			return readT(t, conn, nil) + writeT(t, conn, nil)
 		}
 
-		// rate is 10 bps for 2 seconds, so it should send 20 bytes.
-		// then rate is 5 bps till the end, so it should send rest 30 bytes in 6 seconds.
-		// Eventually it gives us 50 bytes per 8 seconds.
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*8), op)
+		checkQuickOperation(t, 0, op)
 	})
+}
 
-	tOuter.Run("read 50 bytes in 8 seconds using 2 different global rates", func(t *testing.T) {
-		t.Parallel()
-		var rate1, rate2 rate.Limit = 10, 15
-		expectedBytes := 50
+func TestClampToBurst(t *testing.T) {
+	assert.Equal(t, 0, clampToBurst(0, 10))
+	assert.Equal(t, 5, clampToBurst(5, 10))
+	assert.Equal(t, 10, clampToBurst(100, 10))
+	assert.Equal(t, 5, clampToBurst(100, 10, 5))
+	assert.Equal(t, 1, clampToBurst(100, 0), "at least one byte must be requested")
+}
 
-		bl := NewListener(context.Background(), mockListener{})
+// TestReadChargesReceivedBytes tests whether limiters are charged only for bytes which have been really read.
+func TestReadChargesReceivedBytes(tOuter *testing.T) {
+	// Every read returns only half of a buffer, so 5 bytes are charged instead of 10 bytes.
+	// 0 sec -> 5 bytes (5 unused bytes are returned to limiter)
+	// 0.5 sec -> 10 bytes
+	// ...
+	// 2 sec -> 25 bytes
+	var limit rate.Limit = 10
+	expectedBytes := 25
+	expectedSeconds := 2 * time.Second
+
+	tOuter.Run("connection limiter", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockConnListener{conn: mockHalfReadConn{}}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
-		bl.SetLimits(globalLimit, NewConfig(rate1))
+		bl.SetLimits(globalLimit, NewConfig(limit))
 		conn := acceptT(t, bl)
-		b := newSlice(int(rate1))
+		b := newSlice(int(limit))
 
 		var op OperationFunc = func() int {
 			counter := 0
-			i := 0
 			for counter != expectedBytes {
 				counter += readT(t, conn, b)
-				if i == 1 {
-					// Change rate.
-					bl.SetLimits(globalLimit, NewConfig(rate2))
-					b = newSlice(int(rate2))
-				}
-				i++
 			}
 
 			return counter
 		}
 
-		// rate is 10 bps for 2 seconds, so it should read 20 bytes.
-		// then rate is 15 bps till the end, so it should read rest 30 bytes in 2 seconds.
-		// Eventually it gives us 50 bytes per 4 seconds.
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*4), op)
+		checkRate(t, clock, expectedBytes, expectedSeconds, op)
 	})
 
-	tOuter.Run("write 50 bytes in 8 seconds using 2 different connection rates", func(t *testing.T) {
+	tOuter.Run("global limiter", func(t *testing.T) {
 		t.Parallel()
-		var rate1, rate2 rate.Limit = 10, 5
-		expectedBytes := 50
-
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockConnListener{conn: mockHalfReadConn{}}, WithClock(clock))
 		_, connLimit := bl.GetLimits()
-		bl.SetLimits(NewConfig(rate1), connLimit)
+		bl.SetLimits(NewConfig(limit), connLimit)
 		conn := acceptT(t, bl)
-		b := newSlice(int(rate1))
+		b := newSlice(int(limit))
 
 		var op OperationFunc = func() int {
 			counter := 0
-			i := 0
 			for counter != expectedBytes {
-				counter += writeT(t, conn, b)
-				if i == 1 {
-					// Change rate.
-					bl.SetLimits(NewConfig(rate2), connLimit)
-					b = newSlice(int(rate2))
-				}
-				i++
+				counter += readT(t, conn, b)
 			}
 
 			return counter
 		}
 
-		// rate is 10 bps for 2 seconds, so it should send 20 bytes.
-		// then rate is 5 bps till the end, so it should send rest 30 bytes in 6 seconds.
-		// Eventually it gives us 50 bytes per 8 seconds.
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*8), op)
+		checkRate(t, clock, expectedBytes, expectedSeconds, op)
 	})
+}
 
-	tOuter.Run("read 50 bytes in 8 seconds using 2 different connection rates", func(t *testing.T) {
+// TestReturnUnusedBytes tests whether reserved bytes are returned to limiters when they are not transferred.
+func TestReturnUnusedBytes(tOuter *testing.T) {
+	tOuter.Run("short write with an error", func(t *testing.T) {
 		t.Parallel()
-		var rate1, rate2 rate.Limit = 10, 30
-		expectedBytes := 50
-
-		bl := NewListener(context.Background(), mockListener{})
-		globalLimit, _ := bl.GetLimits()
-		bl.SetLimits(globalLimit, NewConfig(rate1))
+		bl := NewListener(context.Background(), mockConnListener{conn: mockHalfWriteConn{}})
+		bl.SetLimits(NewConfig(10), NewConfig(10))
 		conn := acceptT(t, bl)
-		b := newSlice(int(rate1))
 
-		var op OperationFunc = func() int {
-			counter := 0
-			i := 0
-			for counter != expectedBytes {
-				counter += readT(t, conn, b)
-				if i == 1 {
-					// Change rate.
-					bl.SetLimits(globalLimit, NewConfig(rate2))
-					b = newSlice(int(rate2))
-				}
-				i++
-			}
+		n, err := conn.Write(newSlice(10))
+		require.ErrorIs(t, err, io.ErrShortWrite)
+		assert.Equal(t, 5, n)
 
-			return counter
-		}
+		bc := conn.(*connection)
+		assert.InDelta(t, 5, tokens(bc.limiter[writeDirection]), 0.1)
+		assert.InDelta(t, 5, tokens(bl.sharedLimiter[writeDirection]), 0.1)
+	})
 
-		// rate is 10 bps for 2 seconds, so it should read 20 bytes.
-		// then rate is 30 bps till the end, so it should read rest 30 bytes in 1 second.
-		// Eventually it gives us 50 bytes per 3 seconds.
-		checkRate(t, expectedBytes, getRealSeconds(time.Second*3), op)
+	tOuter.Run("failed read", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockConnListener{conn: mockFailedReadConn{}})
+		bl.SetLimits(NewConfig(10), NewConfig(10))
+		conn := acceptT(t, bl)
+
+		n, err := conn.Read(newSlice(10))
+		require.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, 0, n)
+
+		bc := conn.(*connection)
+		assert.InDelta(t, 10, tokens(bc.limiter[readDirection]), 0.1)
+		assert.InDelta(t, 10, tokens(bl.sharedLimiter[readDirection]), 0.1)
 	})
-}
 
-// TestGlobalAndConnectionLimits uses mixed global and connection limiters.
-func TestGlobalAndConnectionLimits(tOuter *testing.T) {
-	var rateConn, rateGlobal rate.Limit = 10, 5
+	tOuter.Run("cancel while waiting for global limiter", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		bl := NewListener(ctx, mockListener{})
+		bl.SetLimits(NewConfig(10), NewConfig(10))
+		conn1 := acceptT(t, bl)
+		conn2 := acceptT(t, bl)
+
+		// The second connection takes all bytes from global limiter.
+		writeT(t, conn2, newSlice(10))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+
+		// The first connection has bytes in its own limiter, but it must wait for global limiter.
+		_, err := conn1.Write(newSlice(10))
+		require.ErrorIs(t, err, context.Canceled)
+
+		bc := conn1.(*connection)
+		assert.InDelta(t, 10, tokens(bc.limiter[writeDirection]), 0.1,
+			"bytes must be returned to connection limiter")
+	})
+}
+
+// TestDeadlines tests whether connection deadlines are respected while waiting for limiters.
+func TestDeadlines(tOuter *testing.T) {
+	tOuter.Run("read fails immediately when deadline would be exceeded", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewConfig(10), NewConfig(10))
+		conn := acceptT(t, bl)
+		readT(t, conn, newSlice(10))
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		start := time.Now()
+		_, err := conn.Read(newSlice(10))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+		assert.Less(t, time.Since(start), 50*time.Millisecond, "it must fail immediately")
+
+		// Write deadline is not affected.
+		writeT(t, conn, newSlice(10))
+	})
+
+	tOuter.Run("write is interrupted when deadline is changed", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewConfig(10), NewConfig(10))
+		conn := acceptT(t, bl)
+		writeT(t, conn, newSlice(10))
+
+		time.AfterFunc(100*time.Millisecond, func() {
+			require.NoError(t, conn.SetDeadline(time.Now()))
+		})
+		start := time.Now()
+		n, err := conn.Write(newSlice(10))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Equal(t, 0, n)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "it must be interrupted before limiter allows it")
+	})
+
+	tOuter.Run("deadline is not exceeded", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		bl.SetLimits(NewConfig(10), NewConfig(10))
+		conn := acceptT(t, bl)
+		require.NoError(t, conn.SetWriteDeadline(clock.Now().Add(2*time.Second)))
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn, newSlice(20))
+		}
+
+		checkRate(t, clock, 20, getRealSeconds(2*time.Second), op)
+	})
+}
+
+// TestClose tests whether closing unblocks goroutines waiting for limiters.
+func TestClose(tOuter *testing.T) {
+	tOuter.Run("close connection while waiting for connection limiter", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		conn := acceptT(t, bl)
+		writeT(t, conn, newSlice(10))
+
+		time.AfterFunc(100*time.Millisecond, func() {
+			require.NoError(t, conn.Close())
+		})
+		start := time.Now()
+		_, err := conn.Write(newSlice(10))
+		require.ErrorIs(t, err, net.ErrClosed)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "it must be interrupted before limiter allows it")
+
+		_, err = conn.Read(newSlice(10))
+		require.ErrorIs(t, err, net.ErrClosed, "closed connection can not be used")
+	})
+
+	tOuter.Run("close connection does not affect other connections", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		conn1 := acceptT(t, bl)
+		conn2 := acceptT(t, bl)
+
+		require.NoError(t, conn1.Close())
+		writeT(t, conn2, newSlice(10))
+	})
+
+	tOuter.Run("close listener with closing connections", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{}, WithCloseConnections())
+		bl.SetLimits(NewConfig(10), NewUnlimitedConfig())
+		conn := acceptT(t, bl)
+		readT(t, conn, newSlice(10))
+
+		time.AfterFunc(100*time.Millisecond, func() {
+			require.NoError(t, bl.Close())
+		})
+		start := time.Now()
+		_, err := conn.Read(newSlice(10))
+		require.ErrorIs(t, err, net.ErrClosed)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "it must be interrupted before limiter allows it")
+	})
+
+	tOuter.Run("close listener without closing connections", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		conn := acceptT(t, bl)
+
+		require.NoError(t, bl.Close())
+		readT(t, conn, newSlice(10))
+	})
+}
+
+// TestConnectionLimitOverride tests whether connection limits can be overridden per connection.
+func TestConnectionLimitOverride(tOuter *testing.T) {
+	tOuter.Run("overridden limit is not affected by listener's connection limits", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		conn := acceptT(t, bl).(Conn)
+		other := acceptT(t, bl).(Conn)
+
+		conn.SetLimit(NewConfig(100))
+		readCfg, writeCfg := conn.Limits()
+		assert.Equal(t, NewConfig(100), readCfg)
+		assert.Equal(t, NewConfig(100), writeCfg)
+
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(20))
+		writeT(t, conn, newSlice(10))
+		writeT(t, other, newSlice(10))
+		readCfg, writeCfg = conn.Limits()
+		assert.Equal(t, NewConfig(100), readCfg)
+		assert.Equal(t, NewConfig(100), writeCfg)
+		readCfg, writeCfg = other.Limits()
+		assert.Equal(t, NewConfig(20), readCfg)
+		assert.Equal(t, NewConfig(20), writeCfg)
+	})
+
+	tOuter.Run("override one direction", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		conn := acceptT(t, bl).(Conn)
+
+		conn.SetReadLimit(NewConfig(100))
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(20))
+		readT(t, conn, newSlice(10))
+		readCfg, writeCfg := conn.Limits()
+		assert.Equal(t, NewConfig(100), readCfg)
+		assert.Equal(t, NewConfig(20), writeCfg)
+
+		conn.SetWriteLimit(NewConfig(50))
+		readCfg, writeCfg = conn.Limits()
+		assert.Equal(t, NewConfig(100), readCfg)
+		assert.Equal(t, NewConfig(50), writeCfg)
+	})
+
+	tOuter.Run("reset limits", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		conn := acceptT(t, bl).(Conn)
+
+		conn.SetLimit(NewConfig(100))
+		conn.ResetLimits()
+		readCfg, writeCfg := conn.Limits()
+		assert.Equal(t, NewConfig(10), readCfg)
+		assert.Equal(t, NewConfig(10), writeCfg)
+	})
+
+	tOuter.Run("write 100 bytes immediately with overridden limit", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		conn := acceptT(t, bl).(Conn)
+		conn.SetLimit(NewUnlimitedConfig())
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn, newSlice(100))
+		}
+
+		checkQuickOperation(t, 100, op)
+	})
+}
+
+// TestSourceLimits tests whether connections from the same source share limiters.
+func TestSourceLimits(tOuter *testing.T) {
+	newSourceListener := func(opts ...Option) (*listener, net.Conn, net.Conn, net.Conn) {
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.1.1:1000"}}
+		bl := NewListener(context.Background(), ml, opts...)
+		bl.SetSourceLimit(NewConfig(10))
+
+		return bl, acceptT(tOuter, bl), acceptT(tOuter, bl), acceptT(tOuter, bl)
+	}
+
+	tOuter.Run("2 connections from the same subnet compete for source rate", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		_, conn1, conn2, _ := newSourceListener(WithSourceLimits(24, 64), WithClock(clock))
+		expectedBytes := 40
+
+		var op OperationFunc = func() int {
+			var counter1, counter2 int
+			wg := sync.WaitGroup{}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for counter1 != expectedBytes/2 {
+					counter1 += writeT(t, conn1, newSlice(10))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for counter2 != expectedBytes/2 {
+					counter2 += writeT(t, conn2, newSlice(10))
+				}
+			}()
+			wg.Wait()
+
+			return counter1 + counter2
+		}
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(4*time.Second), op)
+	})
+
+	tOuter.Run("connections from different subnets do not compete", func(t *testing.T) {
+		t.Parallel()
+		_, conn1, _, conn3 := newSourceListener(WithSourceLimits(24, 64))
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn1, newSlice(10)) + writeT(t, conn3, newSlice(10))
+		}
+
+		checkQuickOperation(t, 20, op)
+	})
+
+	tOuter.Run("connections from different addresses do not compete", func(t *testing.T) {
+		t.Parallel()
+		bl, conn1, conn2, _ := newSourceListener(WithSourceLimits(32, 128))
+		readCfg, writeCfg := bl.SourceLimits()
+		assert.Equal(t, NewConfig(10), readCfg)
+		assert.Equal(t, NewConfig(10), writeCfg)
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn1, newSlice(10)) + writeT(t, conn2, newSlice(10))
+		}
+
+		checkQuickOperation(t, 20, op)
+	})
+
+	tOuter.Run("source limits are not used without option", func(t *testing.T) {
+		t.Parallel()
+		_, conn1, conn2, _ := newSourceListener()
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn1, newSlice(10)) + writeT(t, conn2, newSlice(10))
+		}
+
+		checkQuickOperation(t, 20, op)
+	})
+
+	tOuter.Run("source limits per direction", func(t *testing.T) {
+		t.Parallel()
+		bl, conn1, conn2, _ := newSourceListener(WithSourceLimits(24, 64))
+		bl.SetSourceReadLimit(NewUnlimitedConfig())
+		bl.SetSourceWriteLimit(NewConfig(20))
+		readCfg, writeCfg := bl.SourceLimits()
+		assert.Equal(t, NewUnlimitedConfig(), readCfg)
+		assert.Equal(t, NewConfig(20), writeCfg)
+
+		var op OperationFunc = func() int {
+			return readT(t, conn1, newSlice(100)) + readT(t, conn2, newSlice(100)) +
+				writeT(t, conn1, newSlice(10)) + writeT(t, conn2, newSlice(10))
+		}
+
+		checkQuickOperation(t, 220, op)
+	})
+}
+
+// TestClasses tests traffic classes of connections.
+func TestClasses(tOuter *testing.T) {
+	// Connections from 10.0.0.0/8 are internal, and others are anonymous.
+	classifier := func(conn net.Conn) string {
+		if strings.HasPrefix(conn.RemoteAddr().String(), "10.") {
+			return "internal"
+		}
+
+		return "anonymous"
+	}
+	newClassListener := func(opts ...Option) (*listener, net.Conn, net.Conn, net.Conn) {
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000", "192.168.0.1:1000"}}
+		bl := NewListener(context.Background(), ml, append(opts, WithClassifier(classifier))...)
+
+		return bl, acceptT(tOuter, bl), acceptT(tOuter, bl), acceptT(tOuter, bl)
+	}
+
+	tOuter.Run("connections of the same class compete for class rate", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl, internal1, internal2, anonymous := newClassListener(WithClock(clock))
+		bl.SetClassLimits("internal", NewConfig(10), NewUnlimitedConfig())
+		expectedBytes := 40
+
+		var op OperationFunc = func() int {
+			var counter1, counter2 int
+			wg := sync.WaitGroup{}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for counter1 != expectedBytes/2 {
+					counter1 += writeT(t, internal1, newSlice(10))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for counter2 != expectedBytes/2 {
+					counter2 += writeT(t, internal2, newSlice(10))
+				}
+			}()
+			wg.Wait()
+
+			return counter1 + counter2
+		}
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(4*time.Second), op)
+		// Other class is not limited.
+		checkQuickOperation(t, 100, func() int {
+			return writeT(t, anonymous, newSlice(100))
+		})
+	})
+
+	tOuter.Run("class connection limits are used instead of listener's connection limits", func(t *testing.T) {
+		t.Parallel()
+		bl, internal, _, anonymous := newClassListener()
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		bl.SetClassReadLimits("anonymous", NewUnlimitedConfig(), NewConfig(5))
+		bl.SetClassWriteLimits("anonymous", NewUnlimitedConfig(), NewConfig(50))
+
+		classCfg, connCfg := bl.GetClassReadLimits("anonymous")
+		assert.Equal(t, NewUnlimitedConfig(), classCfg)
+		assert.Equal(t, NewConfig(5), connCfg)
+		_, connCfg = bl.GetClassWriteLimits("anonymous")
+		assert.Equal(t, NewConfig(50), connCfg)
+
+		readT(t, anonymous, nil)
+		readCfg, writeCfg := anonymous.(Conn).Limits()
+		assert.Equal(t, NewConfig(5), readCfg)
+		assert.Equal(t, NewConfig(50), writeCfg)
+
+		readT(t, internal, nil)
+		readCfg, writeCfg = internal.(Conn).Limits()
+		assert.Equal(t, NewConfig(10), readCfg, "class without limits must use listener's connection limits")
+		assert.Equal(t, NewConfig(10), writeCfg, "class without limits must use listener's connection limits")
+	})
+
+	tOuter.Run("class without connection limits follows listener's connection limits", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl, internal, _, anonymous := newClassListener(WithClock(clock))
+		bl.SetClassLimits("internal", NewConfig(1000), Config{})
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+		// Connection of a class which has not been set follows listener's connection limit.
+		checkRate(t, clock, 30, getRealSeconds(3*time.Second), func() int {
+			return writeT(t, anonymous, newSlice(30))
+		})
+
+		// Changes of listener's connection limit are followed by classes without connection limits.
+		bl.SetLimits(NewUnlimitedConfig(), NewConfig(20))
+		checkRate(t, clock, 60, getRealSeconds(3*time.Second), func() int {
+			return writeT(t, internal, newSlice(60))
+		})
+		classCfg, connCfg := bl.GetClassWriteLimits("internal")
+		assert.Equal(t, NewConfig(1000), classCfg)
+		assert.Equal(t, Config{}, connCfg, "connection limit must be inherited")
+	})
+
+	tOuter.Run("class is limited by global limit", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl, internal, _, anonymous := newClassListener(WithClock(clock))
+		bl.SetLimits(NewConfig(10), NewUnlimitedConfig())
+		expectedBytes := 30
+
+		var op OperationFunc = func() int {
+			return writeT(t, internal, newSlice(10)) + writeT(t, anonymous, newSlice(10)) +
+				writeT(t, internal, newSlice(10))
+		}
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(3*time.Second), op)
+	})
+
+	tOuter.Run("class bypasses global limit", func(t *testing.T) {
+		t.Parallel()
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "192.168.0.1:1000"}}
+		bl := NewListener(context.Background(), ml, WithClassifier(classifier))
+		bl.SetLimits(NewConfig(10), NewUnlimitedConfig())
+		bl.SetClassBypassGlobal("internal", true)
+		internal := acceptT(t, bl)
+		anonymous := acceptT(t, bl)
+
+		writeT(t, anonymous, newSlice(10))
+		checkQuickOperation(t, 100, func() int {
+			return writeT(t, internal, newSlice(100))
+		})
+	})
+}
+
+// TestHTB tests connections attached to hierarchical token bucket by their traffic classes.
+func TestHTB(tOuter *testing.T) {
+	// Connections from 10.0.0.0/8 are internal, and others are anonymous.
+	classifier := func(conn net.Conn) string {
+		if strings.HasPrefix(conn.RemoteAddr().String(), "10.") {
+			return "internal"
+		}
+
+		return "anonymous"
+	}
+	newHTBListener := func(t *testing.T, opts ...Option) (*listener, net.Conn, net.Conn) {
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "192.168.0.1:1000"}}
+		bl := NewListener(context.Background(), ml, append(opts, WithClassifier(classifier))...)
+		require.NoError(t, bl.SetHTBNode("root", "", NewConfig(20), NewConfig(20)))
+		// Guaranteed rates and bursts of classes are not greater than root's, so root's ceiling is not exceeded.
+		require.NoError(t, bl.SetHTBNode("internal", "root", NewConfig(15), NewConfig(20)))
+		require.NoError(t, bl.SetHTBNode("anonymous", "root", NewConfig(5), NewConfig(10, 20)))
+
+		return bl, acceptT(t, bl), acceptT(t, bl)
+	}
+
+	tOuter.Run("idle capacity is borrowed up to the ceiling", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		_, _, anonymous := newHTBListener(t, WithClock(clock))
+		expectedBytes := 40
+
+		var op OperationFunc = func() int {
+			return writeT(t, anonymous, newSlice(expectedBytes))
+		}
+
+		// 20 bytes are written at once, because of bursts, and the rest is written with 10 B/s ceiling.
+		checkRate(t, clock, expectedBytes, 2*time.Second, op)
+	})
+
+	tOuter.Run("busy classes do not exceed root ceiling", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		_, internal, anonymous := newHTBListener(t, WithClock(clock))
+		expectedBytes := 80
+
+		var op OperationFunc = func() int {
+			var counter1, counter2 int
+			wg := sync.WaitGroup{}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				counter1 = writeT(t, internal, newSlice(expectedBytes*3/4))
+			}()
+			go func() {
+				defer wg.Done()
+				counter2 = writeT(t, anonymous, newSlice(expectedBytes/4))
+			}()
+			wg.Wait()
+
+			return counter1 + counter2
+		}
+
+		// Root's burst is used at once, and then 20 B/s are shared.
+		checkRate(t, clock, expectedBytes, 3*time.Second, op)
+	})
+
+	tOuter.Run("connections without HTB node are not limited", func(t *testing.T) {
+		t.Parallel()
+		bl, internal, _ := newHTBListener(t)
+		require.NoError(t, bl.RemoveHTBNode("internal"))
+
+		checkQuickOperation(t, 100, func() int {
+			return writeT(t, internal, newSlice(100))
+		})
+	})
+}
+
+func TestFairSharing(tOuter *testing.T) {
+	tOuter.Run("connection with more goroutines does not get more bytes", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl := NewListener(context.Background(), &mockListener{}, WithFairSharing(), WithClock(clock))
+		bl.SetLimits(NewConfig(100, 5), NewUnlimitedConfig())
+		greedy, modest := acceptT(t, bl), acceptT(t, bl)
+		defer greedy.Close()
+
+		// Greedy connection writes in three goroutines until it is closed.
+		for i := 0; i < 3; i++ {
+			go func() {
+				for {
+					if _, err := greedy.Write(newSlice(5)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		expectedBytes := 150
+
+		var op OperationFunc = func() int {
+			return writeT(t, modest, newSlice(expectedBytes))
+		}
+
+		// Both connections get half of the global limit.
+		checkRate(t, clock, expectedBytes, 3*time.Second, op)
+	})
+
+	tOuter.Run("single connection gets the whole global limit", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl := NewListener(context.Background(), &mockListener{}, WithFairSharing(), WithClock(clock))
+		bl.SetLimits(NewConfig(20), NewUnlimitedConfig())
+		conn := acceptT(t, bl)
+		expectedBytes := 60
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn, newSlice(expectedBytes))
+		}
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(3*time.Second), op)
+	})
+
+	// writeInBackground writes into a connection until it is closed.
+	writeInBackground := func(conn net.Conn) {
+		go func() {
+			for {
+				if _, err := conn.Write(newSlice(5)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	tOuter.Run("global limit is shared by weights", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl := NewListener(context.Background(), &mockListener{}, WithFairSharing(), WithClock(clock))
+		bl.SetLimits(NewConfig(100, 5), NewUnlimitedConfig())
+		api, bulk := acceptT(t, bl), acceptT(t, bl)
+		defer bulk.Close()
+		writeInBackground(bulk)
+
+		// Weight can be changed on a live connection.
+		api.(Conn).SetPriority(3, 0)
+		weight, priority := api.(Conn).Priority()
+		assert.Equal(t, 3, weight)
+		assert.Equal(t, 0, priority)
+		expectedBytes := 150
+
+		var op OperationFunc = func() int {
+			return writeT(t, api, newSlice(expectedBytes))
+		}
+
+		// API connection gets 3/4 of the global limit, apart from the first bytes which are allowed by the burst.
+		checkRate(t, clock, expectedBytes, 2*time.Second-100*time.Millisecond, op)
+	})
+
+	tOuter.Run("waiting write continues when global burst is lowered", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		bl := NewListener(context.Background(), &mockListener{}, WithFairSharing(), WithClock(clock))
+		bl.SetLimits(NewConfig(100), NewUnlimitedConfig())
+		conn := acceptT(t, bl)
+		writeT(t, conn, newSlice(100))
+
+		written := make(chan int, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			written <- writeT(t, conn, newSlice(100))
+		}()
+		clock.BlockUntil(1)
+		start := clock.Now()
+		bl.SetLimits(NewConfig(10), NewUnlimitedConfig())
+		advanceUntilDone(clock, done)
+
+		// The write is granted the lowered burst after a second, and the rest is written with the lowered limit.
+		assert.Equal(t, 100, <-written)
+		assert.InDelta(t, 10*time.Second, clock.Now().Sub(start), float64(100*time.Millisecond))
+	})
+
+	tOuter.Run("connection with higher priority is served first", func(t *testing.T) {
+		t.Parallel()
+		prioritizer := func(conn net.Conn) (int, int) {
+			if conn.RemoteAddr().String() == "10.0.0.1:1000" {
+				return 1, 1
+			}
+
+			return 10, 0
+		}
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "192.168.0.1:1000"}}
+		clock := newTestClock()
+		bl := NewListener(context.Background(), ml, WithPrioritizer(prioritizer), WithClock(clock))
+		bl.SetLimits(NewConfig(100, 5), NewUnlimitedConfig())
+		high, low := acceptT(t, bl), acceptT(t, bl)
+		defer low.Close()
+		writeInBackground(low)
+		expectedBytes := 200
+
+		var op OperationFunc = func() int {
+			return writeT(t, high, newSlice(expectedBytes))
+		}
+
+		// Connection with lower priority does not get anything despite its weight.
+		checkRate(t, clock, expectedBytes, 2*time.Second, op)
+	})
+
+	tOuter.Run("priority has no effect without fair sharing", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), &mockListener{})
+		conn := acceptT(t, bl).(Conn)
+		conn.SetPriority(5, 1)
+		weight, priority := conn.Priority()
+		assert.Equal(t, 1, weight)
+		assert.Equal(t, 0, priority)
+	})
+}
+
+func TestQuotas(tOuter *testing.T) {
+	// Connections are counted by remote host.
+	key := func(conn net.Conn) string {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		return host
+	}
+	newQuotaListener := func(q Quota, opts ...Option) (*listener, net.Conn, net.Conn) {
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "10.0.0.1:2000"}}
+		bl := NewListener(context.Background(), ml, append(opts, WithQuotas(key))...)
+		bl.SetQuota(q)
+		conn1, _ := bl.Accept()
+		conn2, _ := bl.Accept()
+
+		return bl, conn1, conn2
+	}
+
+	tOuter.Run("connections with the same key share quota", func(t *testing.T) {
+		t.Parallel()
+		bl, conn1, conn2 := newQuotaListener(NewQuota(100, Daily(nil)))
+
+		assert.Equal(t, 60, writeT(t, conn1, newSlice(60)))
+		n, err := conn2.Write(newSlice(60))
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+		assert.Equal(t, 40, n)
+
+		_, err = conn1.Read(newSlice(10))
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+		assert.Equal(t, int64(100), bl.QuotaUsed("10.0.0.1"))
+	})
+
+	tOuter.Run("read is charged for received bytes", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), &mockAddrListener{addrs: []string{"10.0.0.1:1000"}}, WithQuotas(key))
+		bl.SetQuota(NewQuota(100, Daily(nil)))
+		conn, err := bl.Accept()
+		require.NoError(t, err)
+		conn.(*connection).Conn = mockHalfReadConn{}
+
+		n := readT(t, conn, newSlice(40))
+		assert.Equal(t, int64(n), bl.QuotaUsed("10.0.0.1"))
+	})
+
+	tOuter.Run("connection is throttled when quota is exceeded", func(t *testing.T) {
+		t.Parallel()
+		clock := newTestClock()
+		_, conn1, conn2 := newQuotaListener(NewQuota(100, Daily(nil), NewConfig(10)), WithClock(clock))
+		checkQuickOperation(t, 100, func() int {
+			return writeT(t, conn1, newSlice(100))
+		})
+		expectedBytes := 30
+
+		var op OperationFunc = func() int {
+			return writeT(t, conn2, newSlice(expectedBytes))
+		}
+
+		checkRate(t, clock, expectedBytes, getRealSeconds(3*time.Second), op)
+	})
+
+	tOuter.Run("connections without key do not have quota", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), &mockListener{})
+		bl.SetQuota(NewQuota(10, nil))
+		conn := acceptT(t, bl)
+
+		checkQuickOperation(t, 100, func() int {
+			return writeT(t, conn, newSlice(100))
+		})
+		assert.Equal(t, int64(10), bl.Quota().Bytes())
+	})
+}
+
+func TestStore(tOuter *testing.T) {
+	key := func(conn net.Conn) string {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		return host
+	}
+	newStoreListener := func(t *testing.T, store Store, flushInterval time.Duration) *listener {
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000"}}
+		bl, err := NewListenerWithError(context.Background(), ml, WithQuotas(key), WithStore(store, flushInterval))
+		require.NoError(t, err)
+		bl.SetQuota(NewQuota(100, Daily(nil)))
+
+		return bl
+	}
+
+	tOuter.Run("usage survives restart", func(t *testing.T) {
+		t.Parallel()
+		store := NewFileStore(filepath.Join(t.TempDir(), "usage.json"))
+		bl := newStoreListener(t, store, 0)
+		assert.Equal(t, 60, writeT(t, acceptT(t, bl), newSlice(60)))
+		require.NoError(t, bl.Close())
+
+		bl = newStoreListener(t, store, 0)
+		assert.Equal(t, int64(60), bl.QuotaUsed("10.0.0.1"))
+		n, err := acceptT(t, bl).Write(newSlice(60))
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+		assert.Equal(t, 40, n)
+	})
+
+	tOuter.Run("usage is saved periodically", func(t *testing.T) {
+		t.Parallel()
+		store := NewMemoryStore()
+		bl := newStoreListener(t, store, 10*time.Millisecond)
+		defer bl.Close()
+		writeT(t, acceptT(t, bl), newSlice(60))
+
+		assert.Eventually(t, func() bool {
+			usage, _ := store.Load()
+			return usage["10.0.0.1"].Used == 60
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	tOuter.Run("usage is saved when context is done", func(t *testing.T) {
+		t.Parallel()
+		store := NewMemoryStore()
+		ctx, cancel := context.WithCancel(context.Background())
+		ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000"}}
+		bl, err := NewListenerWithError(ctx, ml, WithQuotas(key), WithStore(store, 0))
+		require.NoError(t, err)
+		writeT(t, acceptT(t, bl), newSlice(60))
+		cancel()
+
+		assert.Eventually(t, func() bool {
+			usage, _ := store.Load()
+			return usage["10.0.0.1"].Used == 60
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	tOuter.Run("listener can not be created when usage can not be loaded", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "usage.json")
+		require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+
+		bl, err := NewListenerWithError(context.Background(), &mockListener{}, WithStore(NewFileStore(path), 0))
+		assert.Error(t, err)
+		assert.Nil(t, bl)
+	})
+
+	tOuter.Run("store requires listener with error", func(t *testing.T) {
+		t.Parallel()
+		assert.Panics(t, func() {
+			NewListener(context.Background(), &mockListener{}, WithStore(NewMemoryStore(), 0))
+		}, "loading errors can not be returned by NewListener")
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	clock := newTestClock()
+	clock.Advance(9 * time.Hour) // 21:00
+	schedule := NewSchedule(time.UTC, NewConfig(5), NewConfig(1))
+	require.NoError(t, schedule.Add("22:00", "06:00", NewConfig(100), NewConfig(10)))
+
+	bl := NewListener(context.Background(), &mockListener{}, WithClock(clock), WithSchedule(schedule))
+	defer bl.Close()
+	globalCfg, connCfg := bl.GetLimits()
+	assert.Equal(t, NewConfig(5), globalCfg, "limits must be set when the listener is created")
+	assert.Equal(t, NewConfig(1), connCfg)
+
+	// Limits are changed at 22:00.
+	clock.BlockUntil(1)
+	clock.Advance(59 * time.Minute)
+	globalCfg, _ = bl.GetLimits()
+	assert.Equal(t, NewConfig(5), globalCfg)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		globalCfg, _ := bl.GetLimits()
+		return globalCfg == NewConfig(100)
+	}, time.Second, time.Millisecond)
+
+	// Manual limits are used until the next change, also after waking up at midnight.
+	bl.SetLimits(NewConfig(50), NewConfig(5))
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Hour)
+	clock.BlockUntil(1)
+	globalCfg, _ = bl.GetLimits()
+	assert.Equal(t, NewConfig(50), globalCfg, "limits of the schedule have not changed at midnight")
+
+	clock.Advance(6 * time.Hour)
+	assert.Eventually(t, func() bool {
+		globalCfg, _ := bl.GetLimits()
+		return globalCfg == NewConfig(5)
+	}, time.Second, time.Millisecond)
+
+	// Rules added later are used without waiting for the next change.
+	clock.BlockUntil(1)
+	require.NoError(t, schedule.Add("06:00", "12:00", NewConfig(20), NewConfig(2)))
+	assert.Eventually(t, func() bool {
+		globalCfg, _ := bl.GetLimits()
+		return globalCfg == NewConfig(20)
+	}, time.Second, time.Millisecond)
+}
+
+// TestFakeClock tests whether waiting for limiters can be advanced virtually.
+func TestFakeClock(t *testing.T) {
+	clock := newTestClock()
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+	defer bl.Close()
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+	conn := acceptT(t, bl)
+
+	// The first 10 bytes are written immediately, and each next 10 bytes after a second.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := conn.Write(newSlice(30))
+		assert.NoError(t, err)
+		assert.Equal(t, 30, n)
+	}()
+
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		select {
+		case <-done:
+			require.FailNow(t, "write must wait for the clock", "after %d seconds", i)
+		default:
+		}
+		clock.Advance(time.Second)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "write must be finished after 2 seconds")
+	}
+}
+
+// TestLimiterFactory tests whether connections are limited by custom limiters.
+func TestLimiterFactory(t *testing.T) {
+	var mutex sync.Mutex
+	var created []*countingLimiter
+	factory := func(c Config) Limiter {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		l := &countingLimiter{Limiter: c.NewLimiter()}
+		created = append(created, l)
+
+		return l
+	}
+	clock := newTestClock()
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock), WithFairSharing(),
+		WithLimiterFactory(factory))
+	defer bl.Close()
+	bl.SetLimits(NewConfig(20), NewConfig(10))
+	conn := acceptT(t, bl)
+	globalLimiter, ok := bl.sharedLimiter[writeDirection].(*countingLimiter)
+	require.True(t, ok, "global limiter must be created by the factory")
+	assert.Same(t, globalLimiter, bl.fair[writeDirection].limiter)
+	connLimiter, ok := conn.(*connection).limiter[writeDirection].(*countingLimiter)
+	require.True(t, ok, "connection limiter must be created by the factory")
+	assert.Equal(t, rate.Limit(20), globalLimiter.Limit())
+	_, writeCfg := conn.(Conn).Limits()
+	assert.Equal(t, NewConfig(10), writeCfg)
+
+	// The first 10 bytes are written immediately, and each next 10 bytes after a second.
+	start := clock.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := conn.Write(newSlice(30))
+		assert.NoError(t, err)
+		assert.Equal(t, 30, n)
+	}()
+	advanceUntilDone(clock, done)
+	assert.Equal(t, 2*time.Second, clock.Now().Sub(start))
+	assert.Equal(t, 30, connLimiter.Reserved())
+	assert.Equal(t, 30, globalLimiter.Reserved())
+
+	require.NoError(t, bl.SetHTBNode("root", "", NewConfig(10), NewConfig(20)))
+	bl.SetClassLimits("internal", NewConfig(100), Config{})
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Len(t, created, 2+2+4+2, "global, connection, HTB and class limiters must be created by the factory")
+}
+
+// TestLimiterAlgorithms tests whether connections are limited by algorithms of their configs.
+func TestLimiterAlgorithms(t *testing.T) {
+	clock := newTestClock()
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+	defer bl.Close()
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10).WithAlgorithm(LeakyBucket))
+	conn := acceptT(t, bl)
+	readCfg, writeCfg := conn.(Conn).Limits()
+	assert.Equal(t, LeakyBucket, readCfg.Algorithm())
+	assert.Equal(t, LeakyBucket, writeCfg.Algorithm())
+
+	// Leaky bucket paces bytes even when they do not exceed the burst.
+	writeT(t, conn, newSlice(5))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := conn.Write(newSlice(5))
+		assert.NoError(t, err)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "write must be finished after 500ms")
+	}
+
+	// Token bucket allows for the whole burst at once.
+	conn.(Conn).SetLimit(NewConfig(10))
+	writeT(t, conn, newSlice(5))
+	writeT(t, conn, newSlice(5))
+}
+
+// TestIPLimits tests whether connections from given subnets get their limits.
+func TestIPLimits(t *testing.T) {
+	ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "192.168.0.1:1000", "10.0.0.2:1000"}}
+	bl := NewListener(context.Background(), ml, WithClassifier(func(net.Conn) string {
+		return "all"
+	}))
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+	bl.SetClassLimits("all", NewUnlimitedConfig(), NewConfig(20))
+	prefix := netip.MustParsePrefix("10.0.0.0/8")
+	bl.SetIPLimits(prefix, NewConfig(100), NewConfig(50))
+	for _, getLimits := range []func(netip.Prefix) (Config, Config){bl.GetIPReadLimits, bl.GetIPWriteLimits} {
+		ipCfg, connCfg := getLimits(prefix)
+		assert.Equal(t, NewConfig(100), ipCfg)
+		assert.Equal(t, NewConfig(50), connCfg)
+	}
+
+	conn1 := acceptT(t, bl)
+	_, writeCfg := conn1.(Conn).Limits()
+	assert.Equal(t, NewConfig(50), writeCfg, "subnet limits must be used instead of class limits")
+	assert.Contains(t, conn1.(*connection).sharedLimiters[writeDirection], limiter(waitingLimiter{bl.ips.Get(prefix).sharedLimiter[writeDirection]}))
+
+	conn2 := acceptT(t, bl)
+	_, writeCfg = conn2.(Conn).Limits()
+	assert.Equal(t, NewConfig(20), writeCfg)
+
+	// Changed limits are used by existing connections.
+	bl.SetIPLimits(prefix, NewConfig(100), NewConfig(60))
+	writeT(t, conn1, newSlice(1))
+	_, writeCfg = conn1.(Conn).Limits()
+	assert.Equal(t, NewConfig(60), writeCfg)
+
+	bl.RemoveIPLimits(prefix)
+	ipCfg, connCfg := bl.GetIPReadLimits(prefix)
+	assert.Equal(t, NewUnlimitedConfig(), ipCfg)
+	assert.Equal(t, Config{}, connCfg, "connection limit of subnet without limits must be inherited")
+	conn3 := acceptT(t, bl)
+	_, writeCfg = conn3.(Conn).Limits()
+	assert.Equal(t, NewConfig(20), writeCfg)
+}
+
+// TestIPLimitsInheritConnLimits tests whether connections from subnets without connection limits
+// follow connection limits of their classes or the listener.
+func TestIPLimitsInheritConnLimits(t *testing.T) {
+	ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000"}}
+	bl := NewListener(context.Background(), ml, WithClassifier(func(conn net.Conn) string {
+		if conn.RemoteAddr().String() == "10.0.0.2:1000" {
+			return "internal"
+		}
+		return ""
+	}))
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+	require.NoError(t, bl.ApplyFileConfig(&FileConfig{
+		Conn: NewConfig(10),
+		IPs:  map[string]IPFileConfig{"10.0.0.0/8": {Limit: NewConfig(100)}},
+	}))
+	unclassified, internal := acceptT(t, bl), acceptT(t, bl)
+	_, writeCfg := unclassified.(Conn).Limits()
+	assert.Equal(t, NewConfig(10), writeCfg, "listener's connection limit must be used")
+
+	// Connection limit of a class is used before listener's one.
+	bl.SetClassLimits("internal", NewUnlimitedConfig(), NewConfig(20))
+	writeT(t, internal, newSlice(1))
+	_, writeCfg = internal.(Conn).Limits()
+	assert.Equal(t, NewConfig(20), writeCfg)
+
+	// Changes of inherited limits are followed.
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(30))
+	writeT(t, unclassified, newSlice(1))
+	_, writeCfg = unclassified.(Conn).Limits()
+	assert.Equal(t, NewConfig(30), writeCfg)
+
+	bl.SetIPLimits(netip.MustParsePrefix("10.0.0.0/8"), NewConfig(100), NewConfig(40))
+	writeT(t, internal, newSlice(1))
+	_, writeCfg = internal.(Conn).Limits()
+	assert.Equal(t, NewConfig(40), writeCfg, "connection limit of subnet must be used before class's one")
+}
+
+// TestConfigFile tests whether limits are loaded from a config file and reloaded when it changes.
+func TestConfigFile(tOuter *testing.T) {
+	tOuter.Run("apply only changes", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), &mockListener{})
+		bl.SetClassLimits("manual", NewConfig(5), NewConfig(5))
+
+		fc := &FileConfig{
+			Global:  NewConfig(100),
+			Classes: map[string]ClassFileConfig{"a": {Limit: NewConfig(10), BypassGlobal: true}},
+			IPs:     map[string]IPFileConfig{"10.0.0.1": {Conn: NewConfig(20)}},
+		}
+		require.NoError(t, bl.ApplyFileConfig(fc))
+		globalCfg, connCfg := bl.GetLimits()
+		assert.Equal(t, NewConfig(100), globalCfg)
+		assert.Equal(t, NewUnlimitedConfig(), connCfg)
+		classCfg, _ := bl.GetClassWriteLimits("a")
+		assert.Equal(t, NewConfig(10), classCfg)
+		assert.True(t, bl.classes.Get("a").BypassGlobal())
+		_, connCfg = bl.GetIPWriteLimits(netip.MustParsePrefix("10.0.0.1/32"))
+		assert.Equal(t, NewConfig(20), connCfg)
+		classCfg, _ = bl.GetClassWriteLimits("manual")
+		assert.Equal(t, NewConfig(5), classCfg, "limits which are not in the config must be kept")
+
+		// Connections are not informed when their limits do not change.
+		c, _ := bl.GetConnCfg()
+		fc = &FileConfig{Global: NewConfig(100), Classes: map[string]ClassFileConfig{"a": {Limit: NewConfig(15)}}}
+		require.NoError(t, bl.ApplyFileConfig(fc))
+		newC, _ := bl.GetConnCfg()
+		assert.Equal(t, c, newC)
+		classCfg, _ = bl.GetClassWriteLimits("a")
+		assert.Equal(t, NewConfig(15), classCfg)
+		assert.False(t, bl.classes.Get("a").BypassGlobal())
+		_, ok := bl.ips.Lookup(netip.MustParsePrefix("10.0.0.1/32"))
+		assert.False(t, ok, "removed subnet must not have limits")
+
+		// Removed class is unlimited.
+		require.NoError(t, bl.ApplyFileConfig(&FileConfig{Global: NewConfig(100)}))
+		classCfg, _ = bl.GetClassWriteLimits("a")
+		assert.Equal(t, NewUnlimitedConfig(), classCfg)
+	})
+
+	tOuter.Run("invalid config is rejected", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), &mockListener{})
+		require.NoError(t, bl.ApplyFileConfig(&FileConfig{Global: NewConfig(100)}))
+
+		err := bl.ApplyFileConfig(&FileConfig{Global: NewConfig(200), IPs: map[string]IPFileConfig{"invalid": {}}})
+		require.Error(t, err)
+		globalCfg, _ := bl.GetLimits()
+		assert.Equal(t, NewConfig(100), globalCfg)
+		require.Error(t, bl.ReloadConfigFile(), "listener without config file can not reload it")
+	})
+
+	tOuter.Run("reload on change", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "limits.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"global": "100B/s"}`), 0o600))
+		clock := NewFakeClock(time.Now())
+		errs := make(chan error, 1)
+		bl, err := NewListenerWithError(context.Background(), &mockListener{}, WithClock(clock),
+			WithConfigFile(path, time.Second, func(err error) {
+				errs <- err
+			}))
+		require.NoError(t, err)
+		defer bl.Close()
+		globalCfg, _ := bl.GetLimits()
+		assert.Equal(t, NewConfig(100), globalCfg)
+
+		require.NoError(t, os.WriteFile(path, []byte(`{"global": "1kB/s"}`), 0o600))
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		assert.Eventually(t, func() bool {
+			globalCfg, _ := bl.GetLimits()
+			return globalCfg == NewConfig(1000)
+		}, time.Second, time.Millisecond)
+
+		// Invalid file is reported, and limits are kept.
+		require.NoError(t, os.WriteFile(path, []byte(`{"global": "fast"}`), 0o600))
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		select {
+		case err := <-errs:
+			require.Error(t, err)
+		case <-time.After(time.Second):
+			require.FailNow(t, "invalid file must be reported")
+		}
+		globalCfg, _ = bl.GetLimits()
+		assert.Equal(t, NewConfig(1000), globalCfg)
+	})
+
+	tOuter.Run("reload on SIGHUP", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "limits.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`conn: 100B/s`), 0o600))
+		bl, err := NewListenerWithError(context.Background(), &mockListener{}, WithConfigFile(path, 0, nil))
+		require.NoError(t, err)
+		defer bl.Close()
+
+		require.NoError(t, os.WriteFile(path, []byte(`conn: 200B/s`), 0o600))
+		process, err := os.FindProcess(os.Getpid())
+		require.NoError(t, err)
+		require.NoError(t, process.Signal(syscall.SIGHUP))
+		assert.Eventually(t, func() bool {
+			_, connCfg := bl.GetLimits()
+			return connCfg == NewConfig(200)
+		}, time.Second, time.Millisecond)
+	})
+
+	tOuter.Run("invalid file when listener is created", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "limits.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"global": "fast"}`), 0o600))
+		bl, err := NewListenerWithError(context.Background(), &mockListener{}, WithConfigFile(path, 0, nil))
+		require.Error(t, err)
+		assert.Nil(t, bl)
+	})
+
+	tOuter.Run("config file requires listener with error", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "limits.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"global": "100B/s"}`), 0o600))
+		assert.Panics(t, func() {
+			NewListener(context.Background(), &mockListener{}, WithConfigFile(path, 0, nil))
+		}, "loading errors can not be returned by NewListener")
+	})
+
+	tOuter.Run("missing file when listener is created", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "limits.json")
+		_, err := NewListenerWithError(context.Background(), &mockListener{}, WithConfigFile(path, 0, nil))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+// TestStats tests whether traffic statistics of connections are added to listener's statistics.
+func TestStats(t *testing.T) {
+	clock := newTestClock()
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+	defer bl.Close()
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+	conn := acceptT(t, bl)
+	closed := acceptT(t, bl)
+	require.NoError(t, closed.Close())
+	require.NoError(t, closed.Close())
+
+	// The first 10 bytes are written immediately, and each next 10 bytes after a second of waiting.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := conn.Write(newSlice(30))
+		assert.NoError(t, err)
+	}()
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "write must be finished after 2 seconds")
+	}
+	_, err := conn.Read(newSlice(5))
+	require.NoError(t, err)
+
+	// Each 10 bytes increase the rate by 10/5s, and the rate decays by e every 5 seconds.
+	rate := 2.0
+	for i := 0; i < 2; i++ {
+		rate = rate*math.Exp(-0.2) + 2
+	}
+	expected := Stats{
+		Read:  DirectionStats{Bytes: 5, Rate: 1},
+		Write: DirectionStats{Bytes: 30, Waits: 2, WaitTime: 2 * time.Second, MaxWait: time.Second, Rate: rate},
+	}
+	stats := conn.(Conn).Stats()
+	assert.InDelta(t, expected.Write.Rate, stats.Write.Rate, 1e-9)
+	stats.Write.Rate = expected.Write.Rate
+	assert.Equal(t, expected, stats)
+
+	listenerStats := bl.Stats()
+	assert.Equal(t, int64(2), listenerStats.Accepted)
+	assert.Equal(t, int64(1), listenerStats.Active)
+	listenerStats.Write.Rate = expected.Write.Rate
+	assert.Equal(t, expected, listenerStats.Stats)
+
+	// The rate decays while nothing is transferred.
+	clock.Advance(5 * time.Second)
+	assert.InDelta(t, rate/math.E, conn.(Conn).Stats().Write.Rate, 1e-9)
+}
+
+// TestGetNewConfig tests whether connections are informed about changed config.
+func TestGetNewConfig(tOuter *testing.T) {
+	tOuter.Run("trigger channel when connection configuration is changed", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		globalLimit, connLimnit := NewConfig(10), NewConfig(20)
+		oldChannel, _ := bl.GetConnCfg()
+		bl.SetLimits(globalLimit, connLimnit)
+		newChannel, newConnCfg := bl.GetConnCfg()
+		assert.Equal(t, connLimnit, newConnCfg[readDirection])
+		assert.Equal(t, connLimnit, newConnCfg[writeDirection])
+		closed := false
+		select {
+		case _, ok := <-oldChannel:
+			closed = !ok
+		default:
+		}
+		assert.Equal(t, true, closed, "old channel should have been closed")
+
+		closed = true
+		select {
+		case <-newChannel:
+		default:
+			closed = false
+		}
+		assert.Equal(t, false, closed, "new channel should not have been closed")
+	})
+
+	tOuter.Run("don't trigger channel when connection configuration is the same", func(t *testing.T) {
+		t.Parallel()
+		bl := NewListener(context.Background(), mockListener{})
+		globalLimit, connLimit := bl.GetLimits()
+		// Set the same values, so configuration should not change.
+		bl.SetLimits(globalLimit, connLimit)
+		newChannel, newConnCfg := bl.GetConnCfg()
+		assert.Equal(t, connLimit, newConnCfg[readDirection])
+		assert.Equal(t, connLimit, newConnCfg[writeDirection])
+
+		closed := true
+		select {
+		case <-newChannel:
+		default:
+			closed = false
+		}
+		assert.Equal(t, false, closed, "new channel should not have been closed")
+	})
+}
+
+// TestChangeLimits changes limits on the fly.
+func TestChangeLimits(tOuter *testing.T) {
+	tOuter.Run("write 50 bytes in 8 seconds using 2 different global rates", func(t *testing.T) {
+		t.Parallel()
+		var rate1, rate2 rate.Limit = 10, 5
+		expectedBytes := 50
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		_, connLimit := bl.GetLimits()
+		bl.SetLimits(NewConfig(rate1), connLimit)
+		conn := acceptT(t, bl)
+		b := newSlice(int(rate1))
+
+		var op OperationFunc = func() int {
+			counter := 0
+			i := 0
+			for counter != expectedBytes {
+				counter += writeT(t, conn, b)
+				if i == 1 {
+					// Change rate.
+					bl.SetLimits(NewConfig(rate2), connLimit)
+					b = newSlice(int(rate2))
+				}
+				i++
+			}
+
+			return counter
+		}
+
+		// rate is 10 bps for 2 seconds, so it should send 20 bytes.
+		// then rate is 5 bps till the end, so it should send rest 30 bytes in 6 seconds.
+		// Eventually it gives us 50 bytes per 8 seconds.
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*8), op)
+	})
+
+	tOuter.Run("read 50 bytes in 8 seconds using 2 different global rates", func(t *testing.T) {
+		t.Parallel()
+		var rate1, rate2 rate.Limit = 10, 15
+		expectedBytes := 50
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		globalLimit, _ := bl.GetLimits()
+		bl.SetLimits(globalLimit, NewConfig(rate1))
+		conn := acceptT(t, bl)
+		b := newSlice(int(rate1))
+
+		var op OperationFunc = func() int {
+			counter := 0
+			i := 0
+			for counter != expectedBytes {
+				counter += readT(t, conn, b)
+				if i == 1 {
+					// Change rate.
+					bl.SetLimits(globalLimit, NewConfig(rate2))
+					b = newSlice(int(rate2))
+				}
+				i++
+			}
+
+			return counter
+		}
+
+		// rate is 10 bps for 2 seconds, so it should read 20 bytes.
+		// then rate is 15 bps till the end, so it should read rest 30 bytes in 2 seconds.
+		// Eventually it gives us 50 bytes per 4 seconds.
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*4), op)
+	})
+
+	tOuter.Run("write 50 bytes in 8 seconds using 2 different connection rates", func(t *testing.T) {
+		t.Parallel()
+		var rate1, rate2 rate.Limit = 10, 5
+		expectedBytes := 50
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		_, connLimit := bl.GetLimits()
+		bl.SetLimits(NewConfig(rate1), connLimit)
+		conn := acceptT(t, bl)
+		b := newSlice(int(rate1))
+
+		var op OperationFunc = func() int {
+			counter := 0
+			i := 0
+			for counter != expectedBytes {
+				counter += writeT(t, conn, b)
+				if i == 1 {
+					// Change rate.
+					bl.SetLimits(NewConfig(rate2), connLimit)
+					b = newSlice(int(rate2))
+				}
+				i++
+			}
+
+			return counter
+		}
+
+		// rate is 10 bps for 2 seconds, so it should send 20 bytes.
+		// then rate is 5 bps till the end, so it should send rest 30 bytes in 6 seconds.
+		// Eventually it gives us 50 bytes per 8 seconds.
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*8), op)
+	})
+
+	tOuter.Run("read 50 bytes in 8 seconds using 2 different connection rates", func(t *testing.T) {
+		t.Parallel()
+		var rate1, rate2 rate.Limit = 10, 30
+		expectedBytes := 50
+
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
+		globalLimit, _ := bl.GetLimits()
+		bl.SetLimits(globalLimit, NewConfig(rate1))
+		conn := acceptT(t, bl)
+		b := newSlice(int(rate1))
+
+		var op OperationFunc = func() int {
+			counter := 0
+			i := 0
+			for counter != expectedBytes {
+				counter += readT(t, conn, b)
+				if i == 1 {
+					// Change rate.
+					bl.SetLimits(globalLimit, NewConfig(rate2))
+					b = newSlice(int(rate2))
+				}
+				i++
+			}
+
+			return counter
+		}
+
+		// rate is 10 bps for 2 seconds, so it should read 20 bytes.
+		// then rate is 30 bps till the end, so it should read rest 30 bytes in 1 second.
+		// Eventually it gives us 50 bytes per 3 seconds.
+		checkRate(t, clock, expectedBytes, getRealSeconds(time.Second*3), op)
+	})
+}
+
+// TestGlobalAndConnectionLimits uses mixed global and connection limiters.
+func TestGlobalAndConnectionLimits(tOuter *testing.T) {
+	var rateConn, rateGlobal rate.Limit = 10, 5
 	var expectedBytes = 70
 	// Why expectedSeconds is 10 seconds?:
 	// Connection limiter is set 10 B/ps, and global is unlimited.
@@ -928,7 +2427,8 @@ func TestGlobalAndConnectionLimits(tOuter *testing.T) {
 	tOuter.Run("read 50 bytes in 8 seconds using 2 different connection and global rates", func(t *testing.T) {
 		t.Parallel()
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		connLimit := NewConfig(rateConn)
 		bl.SetLimits(globalLimit, connLimit)
@@ -950,13 +2450,14 @@ func TestGlobalAndConnectionLimits(tOuter *testing.T) {
 			return counter
 		}
 
-		checkRate(t, expectedBytes, expectedSeconds, op)
+		checkRate(t, clock, expectedBytes, expectedSeconds, op)
 	})
 
 	tOuter.Run("write 50 bytes in 8 seconds using 2 different connection and global rates", func(t *testing.T) {
 		t.Parallel()
 
-		bl := NewListener(context.Background(), mockListener{})
+		clock := newTestClock()
+		bl := NewListener(context.Background(), mockListener{}, WithClock(clock))
 		globalLimit, _ := bl.GetLimits()
 		connLimit := NewConfig(rateConn)
 		bl.SetLimits(globalLimit, connLimit)
@@ -981,7 +2482,7 @@ func TestGlobalAndConnectionLimits(tOuter *testing.T) {
 			return counter
 		}
 
-		checkRate(t, expectedBytes, expectedSeconds, op)
+		checkRate(t, clock, expectedBytes, expectedSeconds, op)
 	})
 }
 
@@ -1023,7 +2524,7 @@ func (mockConn) Write(b []byte) (n int, err error) {
 }
 
 func (mockConn) Close() error {
-	panic("implement me")
+	return nil
 }
 
 func (mockConn) LocalAddr() net.Addr {
@@ -1035,25 +2536,89 @@ func (mockConn) RemoteAddr() net.Addr {
 }
 
 func (mockConn) SetDeadline(_ time.Time) error {
-	panic("implement me")
+	return nil
 }
 
 func (mockConn) SetReadDeadline(_ time.Time) error {
-	panic("implement me")
+	return nil
 }
 
 func (mockConn) SetWriteDeadline(_ time.Time) error {
-	panic("implement me")
+	return nil
 }
 
 func (mockListener) Close() error {
-	panic("implement me")
+	return nil
 }
 
 func (mockListener) Addr() net.Addr {
 	panic("implement me")
 }
 
+// mockConnListener accepts always the same connection.
+type mockConnListener struct {
+	mockListener
+	conn net.Conn
+}
+
+func (ml mockConnListener) Accept() (net.Conn, error) {
+	return ml.conn, nil
+}
+
+// mockHalfReadConn reads only half of a given buffer.
+type mockHalfReadConn struct {
+	mockConn
+}
+
+func (mockHalfReadConn) Read(b []byte) (n int, err error) {
+	return len(b) / 2, nil
+}
+
+// mockHalfWriteConn writes only half of a given buffer.
+type mockHalfWriteConn struct {
+	mockConn
+}
+
+func (mockHalfWriteConn) Write(b []byte) (n int, err error) {
+	return len(b) / 2, io.ErrShortWrite
+}
+
+// mockFailedReadConn always fails to read.
+type mockFailedReadConn struct {
+	mockConn
+}
+
+func (mockFailedReadConn) Read(_ []byte) (n int, err error) {
+	return 0, io.EOF
+}
+
+// mockAddrListener accepts connections with given remote addresses one by one.
+type mockAddrListener struct {
+	mockListener
+	mutex sync.Mutex
+	addrs []string
+}
+
+func (ml *mockAddrListener) Accept() (net.Conn, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	addr := ml.addrs[0]
+	ml.addrs = ml.addrs[1:]
+
+	return mockAddrConn{addr: mockAddr(addr)}, nil
+}
+
+// mockAddrConn is a connection with a remote address.
+type mockAddrConn struct {
+	mockConn
+	addr net.Addr
+}
+
+func (c mockAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
 // newSlice returns slice with a fixed zeroed length.
 func newSlice(length int) []byte {
 	return make([]byte, length)
@@ -1081,16 +2646,24 @@ func getRealSeconds(t time.Duration) time.Duration {
 }
 
 // checkRate checks actual rate if it is included in threshold -/+5%.
-func checkRate(t *testing.T, expectedBytes int, expectedSeconds time.Duration, op OperationFunc) {
+// The operation runs with a fake clock, which is advanced whenever the operation waits for limiters,
+// so rates are measured in virtual time and the test does not wait for real time.
+func checkRate(t *testing.T, clock *FakeClock, expectedBytes int, expectedSeconds time.Duration, op OperationFunc) {
 	require.GreaterOrEqual(t, expectedSeconds, time.Second, "operation must take more than 1 second")
 
 	// Act. Measure operation.
-	start := time.Now()
-	gotBytes := op()
-	seconds := time.Since(start).Seconds()
+	start := clock.Now()
+	var gotBytes int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gotBytes = op()
+	}()
+	advanceUntilDone(clock, done)
+	seconds := clock.Now().Sub(start).Seconds()
 
 	// Assert.
-	require.Greater(t, seconds, 1.0, "operation took less than 1 second")
+	require.GreaterOrEqual(t, seconds, 1.0, "operation took less than 1 second")
 	assert.Equal(t, expectedBytes, gotBytes, "processed number of bytes is not the same")
 	expectedBps := float64(expectedBytes) / expectedSeconds.Seconds()
 	gotBps := float64(gotBytes) / seconds
@@ -1105,3 +2678,34 @@ func checkRate(t *testing.T, expectedBytes int, expectedSeconds time.Duration, o
 			"gotBytes=%d, gotSeconds=%f, expectedBytes=%d, expectedSeconds=%f",
 		gotBytes, seconds, expectedBytes, expectedSeconds.Seconds())
 }
+
+// advanceUntilDone advances a fake clock to its earliest timer whenever goroutines wait for it, until done is closed.
+// Time is advanced only when waiting timers have not changed since the previous check, so goroutines which are
+// about to wait for limiters do it before time moves, and they see each step of time.
+// Goroutines run in real time, so they are checked every millisecond.
+func advanceUntilDone(clock *FakeClock, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	lastN, lastNext := -1, time.Time{}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		n, next := clock.Waiting()
+		if n == 0 || n != lastN || !next.Equal(lastNext) {
+			lastN, lastNext = n, next
+			continue
+		}
+		clock.AdvanceToNextTimer()
+		lastN = -1
+	}
+}
+
+// newTestClock returns a fake clock for tests.
+func newTestClock() *FakeClock {
+	return NewFakeClock(time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC))
+}
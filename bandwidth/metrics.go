@@ -0,0 +1,178 @@
+package bandwidth
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// metricsContentType is a content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// labelEscaper escapes label values of the Prometheus text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricsHandler returns an HTTP handler which serves listener's metrics in the Prometheus text exposition format.
+// Metrics are labeled by direction and traffic class, and empty class means connections without class
+// or limits of the listener:
+//
+//   - bandwidth_connections_accepted_total and bandwidth_connections_active count connections,
+//   - bandwidth_bytes_total counts transferred bytes,
+//   - bandwidth_wait_seconds is a histogram of waits for limiters,
+//   - bandwidth_rate_bytes_per_second is an effective rate averaged over the last seconds,
+//   - bandwidth_limit_bytes_per_second and bandwidth_burst_bytes are configured limits,
+//     where scope "shared" is global or class limit, and scope "conn" is a limit of each connection.
+func (bl *listener) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var buf bytes.Buffer
+		bl.writeMetrics(&buf)
+
+		w.Header().Set("Content-Type", metricsContentType)
+		_, _ = w.Write(buf.Bytes())
+	})
+}
+
+// classMetrics are traffic and limits of a traffic class, or of the listener when name is empty.
+type classMetrics struct {
+	name    string
+	traffic *traffic
+	limits  *limitGroup
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format.
+func (bl *listener) writeMetrics(buf *bytes.Buffer) {
+	now := bl.clock.Now()
+	groups := []classMetrics{{name: "", traffic: &bl.unclassified, limits: &bl.limitGroup}}
+	for _, name := range bl.classes.Names() {
+		cl := bl.classes.Get(name)
+		groups = append(groups, classMetrics{name: name, traffic: &cl.traffic, limits: &cl.limitGroup})
+	}
+
+	writeFamily(buf, "bandwidth_connections_accepted_total", "counter", "Number of accepted connections.")
+	for _, g := range groups {
+		writeSample(buf, "bandwidth_connections_accepted_total", float64(g.traffic.accepted.Load()), "class", g.name)
+	}
+
+	writeFamily(buf, "bandwidth_connections_active", "gauge", "Number of connections which have not been closed yet.")
+	for _, g := range groups {
+		writeSample(buf, "bandwidth_connections_active", float64(g.traffic.active.Load()), "class", g.name)
+	}
+
+	type snapshot struct {
+		stats DirectionStats
+		waits [len(waitBuckets)]int64
+	}
+	snapshots := make([][directions]snapshot, len(groups))
+	for i, g := range groups {
+		for _, d := range bothDirections {
+			snapshots[i][d].stats, snapshots[i][d].waits = g.traffic.stats[d].Histogram(now)
+		}
+	}
+
+	writeFamily(buf, "bandwidth_bytes_total", "counter", "Number of transferred bytes.")
+	for i, g := range groups {
+		for _, d := range bothDirections {
+			writeSample(buf, "bandwidth_bytes_total", float64(snapshots[i][d].stats.Bytes),
+				"direction", d.String(), "class", g.name)
+		}
+	}
+
+	writeFamily(buf, "bandwidth_wait_seconds", "histogram", "Time spent waiting for limiters.")
+	for i, g := range groups {
+		for _, d := range bothDirections {
+			s := snapshots[i][d]
+			for j, bound := range waitBuckets {
+				writeSample(buf, "bandwidth_wait_seconds_bucket", float64(s.waits[j]),
+					"direction", d.String(), "class", g.name, "le", formatFloat(bound.Seconds()))
+			}
+			writeSample(buf, "bandwidth_wait_seconds_bucket", float64(s.stats.Waits),
+				"direction", d.String(), "class", g.name, "le", "+Inf")
+			writeSample(buf, "bandwidth_wait_seconds_sum", s.stats.WaitTime.Seconds(),
+				"direction", d.String(), "class", g.name)
+			writeSample(buf, "bandwidth_wait_seconds_count", float64(s.stats.Waits),
+				"direction", d.String(), "class", g.name)
+		}
+	}
+
+	writeFamily(buf, "bandwidth_rate_bytes_per_second", "gauge", "Effective rate averaged over the last seconds.")
+	for i, g := range groups {
+		for _, d := range bothDirections {
+			writeSample(buf, "bandwidth_rate_bytes_per_second", snapshots[i][d].stats.Rate,
+				"direction", d.String(), "class", g.name)
+		}
+	}
+
+	limits := make([][directions][2]Config, len(groups))
+	for i, g := range groups {
+		// Missing connection limits of classes are inherited from the listener.
+		_, connCfg := limitChain{g.limits, &bl.limitGroup}.GetConnCfg()
+		for _, d := range bothDirections {
+			sharedCfg, _ := g.limits.getLimits(d)
+			limits[i][d] = [2]Config{sharedCfg, connCfg[d]}
+		}
+	}
+	scopes := [2]string{"shared", "conn"}
+
+	writeFamily(buf, "bandwidth_limit_bytes_per_second", "gauge", "Configured limit, which is +Inf when it is unlimited.")
+	for i, g := range groups {
+		for _, d := range bothDirections {
+			for j, scope := range scopes {
+				writeSample(buf, "bandwidth_limit_bytes_per_second", limitValue(limits[i][d][j].limit),
+					"direction", d.String(), "class", g.name, "scope", scope)
+			}
+		}
+	}
+
+	writeFamily(buf, "bandwidth_burst_bytes", "gauge", "Configured burst.")
+	for i, g := range groups {
+		for _, d := range bothDirections {
+			for j, scope := range scopes {
+				writeSample(buf, "bandwidth_burst_bytes", float64(limits[i][d][j].burst),
+					"direction", d.String(), "class", g.name, "scope", scope)
+			}
+		}
+	}
+}
+
+// writeFamily writes help and type of a metric family.
+func writeFamily(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSample writes a sample of a metric with labels given as pairs of names and values.
+func writeSample(buf *bytes.Buffer, name string, value float64, labels ...string) {
+	buf.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 1 {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(value))
+	buf.WriteByte('\n')
+}
+
+// limitValue returns a limit in bytes per second, which is +Inf for unlimited config.
+func limitValue(limit rate.Limit) float64 {
+	if limit == rate.Inf {
+		return math.Inf(1)
+	}
+
+	return float64(limit)
+}
+
+// formatFloat formats a value of a sample, e.g. 0.25, 1e+06 or +Inf.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
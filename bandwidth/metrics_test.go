@@ -0,0 +1,71 @@
+package bandwidth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	clock := newTestClock()
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock), WithClassifier(func(net.Conn) string {
+		return "gold"
+	}))
+	defer bl.Close()
+	bl.SetLimits(NewConfig(1000, 2000), NewUnlimitedConfig())
+	bl.SetClassLimits("gold", NewUnlimitedConfig(), NewConfig(10))
+	bl.SetClassLimits(`a"b`, NewUnlimitedConfig(), NewUnlimitedConfig())
+	conn := acceptT(t, bl)
+
+	// The first 10 bytes are written immediately, and the next 10 bytes after 2 seconds of waiting.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := conn.Write(newSlice(10))
+		assert.NoError(t, err)
+		_, err = conn.Write(newSlice(10))
+		assert.NoError(t, err)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "write must be finished after 2 seconds")
+	}
+
+	recorder := httptest.NewRecorder()
+	bl.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, metricsContentType, recorder.Header().Get("Content-Type"))
+
+	lines := strings.Split(recorder.Body.String(), "\n")
+	for _, expected := range []string{
+		`# TYPE bandwidth_bytes_total counter`,
+		`# TYPE bandwidth_wait_seconds histogram`,
+		`bandwidth_connections_accepted_total{class="gold"} 1`,
+		`bandwidth_connections_active{class="gold"} 1`,
+		`bandwidth_connections_active{class=""} 0`,
+		`bandwidth_connections_active{class="a\"b"} 0`,
+		`bandwidth_bytes_total{direction="write",class="gold"} 20`,
+		`bandwidth_bytes_total{direction="read",class="gold"} 0`,
+		`bandwidth_wait_seconds_bucket{direction="write",class="gold",le="1"} 0`,
+		`bandwidth_wait_seconds_bucket{direction="write",class="gold",le="2.5"} 1`,
+		`bandwidth_wait_seconds_bucket{direction="write",class="gold",le="+Inf"} 1`,
+		`bandwidth_wait_seconds_sum{direction="write",class="gold"} 2`,
+		`bandwidth_wait_seconds_count{direction="write",class="gold"} 1`,
+		`bandwidth_limit_bytes_per_second{direction="read",class="",scope="shared"} 1000`,
+		`bandwidth_limit_bytes_per_second{direction="read",class="",scope="conn"} +Inf`,
+		`bandwidth_limit_bytes_per_second{direction="write",class="gold",scope="conn"} 10`,
+		`bandwidth_burst_bytes{direction="write",class="",scope="shared"} 2000`,
+	} {
+		assert.Contains(t, lines, expected)
+	}
+}
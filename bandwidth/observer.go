@@ -0,0 +1,45 @@
+package bandwidth
+
+import "time"
+
+// Observer is notified about connections, throttling and changes of limits, e.g. for logging, auditing or alerting.
+// Its methods are called synchronously by the goroutine which caused the event, so they should return quickly.
+// Embed NopObserver to implement only some of them.
+type Observer interface {
+	// OnAccept is called when a connection is accepted, before it is returned by Accept.
+	OnAccept(conn Conn)
+	// OnClose is called once when a connection is closed.
+	OnClose(conn Conn)
+	// OnThrottle is called when bytes of a connection have not been allowed immediately by limiters,
+	// after they have waited for a given time.
+	OnThrottle(conn Conn, bytes int, wait time.Duration)
+	// OnLimitsChanged is called when global or connection limits of the listener are changed.
+	OnLimitsChanged(old, new Limits)
+	// OnQuotaExceeded is called when a quota of a given key is exhausted for the first time in its window,
+	// by a connection which has exhausted it.
+	OnQuotaExceeded(conn Conn, key string)
+}
+
+// Limits are global and connection limits of a listener.
+type Limits struct {
+	GlobalRead, GlobalWrite Config
+	ConnRead, ConnWrite     Config
+}
+
+// NopObserver is an Observer which ignores all events.
+type NopObserver struct{}
+
+// OnAccept does nothing.
+func (NopObserver) OnAccept(Conn) {}
+
+// OnClose does nothing.
+func (NopObserver) OnClose(Conn) {}
+
+// OnThrottle does nothing.
+func (NopObserver) OnThrottle(Conn, int, time.Duration) {}
+
+// OnLimitsChanged does nothing.
+func (NopObserver) OnLimitsChanged(_, _ Limits) {}
+
+// OnQuotaExceeded does nothing.
+func (NopObserver) OnQuotaExceeded(Conn, string) {}
@@ -0,0 +1,106 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingObserver records all events as texts.
+type recordingObserver struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) Events() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	events := o.events
+	o.events = nil
+
+	return events
+}
+
+func (o *recordingObserver) OnAccept(Conn) {
+	o.record("accept")
+}
+
+func (o *recordingObserver) OnClose(Conn) {
+	o.record("close")
+}
+
+func (o *recordingObserver) OnThrottle(_ Conn, bytes int, wait time.Duration) {
+	o.record("throttle %d %v", bytes, wait)
+}
+
+func (o *recordingObserver) OnLimitsChanged(old, new Limits) {
+	o.record("limits %v/%v/%v -> %v/%v/%v", old.GlobalWrite, old.ConnWrite, old.GlobalRead,
+		new.GlobalWrite, new.ConnWrite, new.GlobalRead)
+}
+
+func (o *recordingObserver) OnQuotaExceeded(_ Conn, key string) {
+	o.record("quota %s", key)
+}
+
+func TestObserver(t *testing.T) {
+	clock := newTestClock()
+	observer := &recordingObserver{}
+	bl := NewListener(context.Background(), mockListener{}, WithClock(clock), WithObserver(observer),
+		WithQuotas(func(net.Conn) string {
+			return "user"
+		}))
+	defer bl.Close()
+
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+	bl.SetReadLimits(NewConfig(100), NewConfig(10))
+	assert.Equal(t, []string{
+		"limits unlimited/unlimited/unlimited -> unlimited/10B/s/unlimited",
+		"limits unlimited/10B/s/unlimited -> unlimited/10B/s/100B/s",
+	}, observer.Events(), "the same limits must not be reported")
+
+	bl.SetQuota(NewQuota(20, nil))
+	conn := acceptT(t, bl)
+	assert.Equal(t, []string{"accept"}, observer.Events())
+
+	// The first 10 bytes are written immediately, and the next 10 bytes after a second of waiting.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := conn.Write(newSlice(20))
+		assert.NoError(t, err)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "write must be finished after a second")
+	}
+	assert.Equal(t, []string{"throttle 10 1s"}, observer.Events())
+
+	// Exhausted quota is reported once per window.
+	for i := 0; i < 2; i++ {
+		_, err := conn.Write(newSlice(1))
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+	}
+	assert.Equal(t, []string{"quota user"}, observer.Events())
+
+	require.NoError(t, conn.Close())
+	require.NoError(t, conn.Close())
+	assert.Equal(t, []string{"close"}, observer.Events())
+}
@@ -0,0 +1,126 @@
+package bandwidth
+
+import "time"
+
+// Option configures a listener when it is created.
+type Option func(*listener)
+
+// WithCloseConnections makes listener's Close interrupt all accepted connections.
+// Goroutines waiting for limiters get net.ErrClosed, and so do all next reads and writes.
+func WithCloseConnections() Option {
+	return func(bl *listener) {
+		bl.closeConns = true
+	}
+}
+
+// WithSourceLimits makes connections from the same source share limiters, which are set by SetSourceLimit.
+// Source is a subnet of a remote IP address with a given prefix length, e.g. /24 for IPv4 and /64 for IPv6.
+// Use 32 and 128 to share limiters by connections from the same remote IP address.
+// Limiters of a source are removed from memory when it does not have connections, and its limiters are full.
+func WithSourceLimits(ipv4Bits, ipv6Bits int) Option {
+	return func(bl *listener) {
+		bl.sources.enable(ipv4Bits, ipv6Bits)
+	}
+}
+
+// WithClassifier assigns accepted connections to traffic classes by a given classifier.
+// Each class has its own limit shared by all connections of the class and its own connection limit,
+// which are set by SetClassLimits. Connections of a class are also limited by global limit,
+// unless SetClassBypassGlobal is used.
+func WithClassifier(classifier Classifier) Option {
+	return func(bl *listener) {
+		bl.classes.classifier = classifier
+	}
+}
+
+// WithFairSharing makes connections share global limit fairly.
+// By default, global limiter serves connections in order of their requests, so a connection
+// with larger buffers or more goroutines gets more bytes. With fair sharing, each connection which waits
+// for global limiter gets an equal share of global limit, counted in bytes.
+func WithFairSharing() Option {
+	return func(bl *listener) {
+		for _, d := range bothDirections {
+			if bl.fair[d] == nil {
+				bl.fair[d] = newFairScheduler(bl.clock, bl.sharedLimiter[d])
+			}
+		}
+	}
+}
+
+// WithPrioritizer makes connections share global limit fairly, like WithFairSharing,
+// with weights and priorities returned by a given prioritizer for accepted connections.
+// Weight and priority of a connection can be changed later by Conn.SetPriority.
+func WithPrioritizer(prioritizer Prioritizer) Option {
+	return func(bl *listener) {
+		WithFairSharing()(bl)
+		bl.prioritizer = prioritizer
+	}
+}
+
+// WithLimiterFactory makes the listener create all its limiters by a given factory, so custom implementations
+// of Limiter can be used for global, connection, source, class, subnet and HTB limits, and for fallback
+// limits of quotas. By default, limiters use algorithms selected by their configs, see Config.NewLimiter.
+// Custom limiters keep their algorithm, so only their rate and burst are changed when limits are changed.
+func WithLimiterFactory(factory LimiterFactory) Option {
+	return func(bl *listener) {
+		bl.setLimiterFactory(factory)
+	}
+}
+
+// WithQuotas counts bytes read and written by connections with the same key, which is returned by a given function.
+// Quota for each key is set by SetQuota, and by default it is unlimited.
+func WithQuotas(key QuotaKey) Option {
+	return func(bl *listener) {
+		bl.quotas.key = key
+	}
+}
+
+// WithStore keeps usage of quotas in a given store, so it survives restarts.
+// Usage is loaded when the listener is created, so the option requires NewListenerWithError,
+// which returns an error when usage can not be loaded.
+// Usage is saved every flushInterval, when the listener is closed, and when the listener's context is done.
+// Zero flushInterval means that usage is saved only on shutdown.
+func WithStore(store Store, flushInterval time.Duration) Option {
+	return func(bl *listener) {
+		bl.store = store
+		bl.flushInterval = flushInterval
+	}
+}
+
+// WithClock makes the listener, its limiters and connections use a given clock instead of real time,
+// e.g. FakeClock in tests, so waiting for limiters can be advanced virtually.
+// Keep in mind that deadlines of connections are compared with time of the clock.
+func WithClock(clock Clock) Option {
+	return func(bl *listener) {
+		bl.setClock(clock)
+	}
+}
+
+// WithSchedule makes global and connection limits follow a given schedule.
+// Limits of the schedule are set when the listener is created, and whenever they change,
+// also because of rules added later. Limits set manually by SetLimits are used until limits of the schedule change.
+func WithSchedule(schedule *Schedule) Option {
+	return func(bl *listener) {
+		bl.schedule = schedule
+	}
+}
+
+// WithObserver makes the listener notify a given observer about connections, throttling and changes of limits.
+func WithObserver(observer Observer) Option {
+	return func(bl *listener) {
+		bl.observer = observer
+	}
+}
+
+// WithConfigFile loads limits from a JSON or YAML file, see FileConfig, when the listener is created,
+// so the option requires NewListenerWithError, which returns an error when the file can not be loaded.
+// The file is reloaded on SIGHUP, and when its modification time or size changes, which is checked
+// every pollInterval. Zero pollInterval means that it is reloaded only on SIGHUP or by ReloadConfigFile.
+// When a reloaded file is invalid, then limits are not changed, and the error is passed to onError, which can be nil.
+func WithConfigFile(path string, pollInterval time.Duration, onError func(err error)) Option {
+	return func(bl *listener) {
+		bl.configPath = path
+		bl.configPollInterval = pollInterval
+		bl.configErrors = onError
+	}
+}
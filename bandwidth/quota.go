@@ -0,0 +1,394 @@
+package bandwidth
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by Read and Write when a byte quota of the connection is exhausted,
+// and the quota does not have a fallback limit.
+var ErrQuotaExceeded = errors.New("bandwidth: quota exceeded")
+
+// Window returns the start of a quota window which contains a given time.
+// Quota usage is reset when a new window starts.
+type Window func(t time.Time) time.Time
+
+// Every returns windows of a given duration, which start at multiples of the duration since zero time.
+func Every(d time.Duration) Window {
+	return func(t time.Time) time.Time {
+		return t.Truncate(d)
+	}
+}
+
+// Daily returns windows which start at midnight in a given location. Nil location means UTC.
+func Daily(loc *time.Location) Window {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return func(t time.Time) time.Time {
+		t = t.In(loc)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+// Monthly returns windows which start at midnight of the first day of a month in a given location.
+// Nil location means UTC.
+func Monthly(loc *time.Location) Window {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return func(t time.Time) time.Time {
+		t = t.In(loc)
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+}
+
+// QuotaKey returns a key of an accepted connection, which quota is counted for, e.g. a client's IP address or user ID.
+// Connections with the same key share a quota. Empty key means that the connection does not have a quota.
+type QuotaKey func(conn net.Conn) string
+
+// Quota is a limit of bytes which can be read and written in a window.
+type Quota struct {
+	bytes  int64
+	window Window
+	// fallback is a limit config used when the quota is exhausted.
+	// It is nil when Read and Write should return ErrQuotaExceeded.
+	fallback *Config
+}
+
+// NewQuota returns a quota of bytes which can be read and written in each window, e.g. 10 GiB per day.
+// When the quota is exhausted then connections are limited by a fallback config if it is given,
+// and otherwise Read and Write return ErrQuotaExceeded. Nil window means that the quota is never reset.
+func NewQuota(bytes int64, window Window, fallback ...Config) Quota {
+	q := Quota{bytes: bytes, window: window}
+	if len(fallback) > 0 {
+		q.fallback = &fallback[0]
+	}
+
+	return q
+}
+
+// NewUnlimitedQuota returns a quota which is never exhausted.
+func NewUnlimitedQuota() Quota {
+	return Quota{bytes: math.MaxInt64}
+}
+
+// Bytes returns a number of bytes which can be read and written in a window.
+func (q Quota) Bytes() int64 {
+	return q.bytes
+}
+
+// Fallback returns a limit config used when the quota is exhausted.
+// It returns false when Read and Write return ErrQuotaExceeded instead.
+func (q Quota) Fallback() (Config, bool) {
+	if q.fallback == nil {
+		return Config{}, false
+	}
+
+	return *q.fallback, true
+}
+
+// windowStart returns the start of a window which contains a given time.
+func (q Quota) windowStart(t time.Time) time.Time {
+	if q.window == nil {
+		return time.Time{}
+	}
+
+	return q.window(t)
+}
+
+// fallbackConfig returns a limit config of a fallback limiter.
+func (q Quota) fallbackConfig() Config {
+	if q.fallback == nil {
+		return NewUnlimitedConfig()
+	}
+
+	return *q.fallback
+}
+
+// quotas keeps quota counters of connections by their keys.
+type quotas struct {
+	mutex sync.Mutex
+	// key returns keys of connections. It is nil when quotas are not enabled.
+	key      QuotaKey
+	cfg      Quota
+	counters map[string]*quotaCounter
+	// lastSweep is a time when idle counters were evicted last time.
+	lastSweep time.Time
+	// clock tells the time of windows.
+	clock Clock
+	// newLimiter creates fallback limiters of new counters.
+	newLimiter LimiterFactory
+}
+
+// quotaCounter counts bytes of connections with the same key.
+type quotaCounter struct {
+	mutex sync.Mutex
+	cfg   Quota
+	// used is a number of bytes used in the current window.
+	used int64
+	// start is the start of the current window.
+	start time.Time
+	// fallback is a limiter per direction used when the quota is exhausted.
+	fallback [directions]Limiter
+	// conns is a number of open connections with the key.
+	conns int
+	// key is a key of connections which share the quota.
+	key string
+	// exceeded is true when exhausting of the quota has been reported in the current window.
+	exceeded bool
+}
+
+func newQuotas() *quotas {
+	return &quotas{
+		cfg:        NewUnlimitedQuota(),
+		counters:   make(map[string]*quotaCounter),
+		clock:      systemClock{},
+		newLimiter: newBucketLimiter,
+	}
+}
+
+// Config returns a quota of each key.
+func (qs *quotas) Config() Quota {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	return qs.cfg
+}
+
+// SetConfig sets a quota of each key. Existing counters get the new quota immediately, and their usage is kept.
+func (qs *quotas) SetConfig(q Quota) {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	qs.cfg = q
+	now := qs.clock.Now()
+	for _, qc := range qs.counters {
+		qc.setConfig(now, q)
+	}
+}
+
+// Used returns a number of bytes used by a given key in the current window.
+func (qs *quotas) Used(key string) int64 {
+	qs.mutex.Lock()
+	qc, ok := qs.counters[key]
+	qs.mutex.Unlock()
+	if !ok {
+		return 0
+	}
+
+	return qc.Used(qs.clock.Now())
+}
+
+// Acquire returns a quota counter for a given connection.
+// Returned function must be called when the connection is closed.
+// It returns false when quotas are not enabled or the connection does not have a key.
+func (qs *quotas) Acquire(conn net.Conn) (*quotaCounter, func(), bool) {
+	qs.mutex.Lock()
+	key := qs.key
+	qs.mutex.Unlock()
+	if key == nil {
+		return nil, nil, false
+	}
+
+	// Key is computed without mutex, because it can take a while.
+	name := key(conn)
+	if name == "" {
+		return nil, nil, false
+	}
+
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	now := qs.clock.Now()
+	qs.sweep(now)
+
+	qc, ok := qs.counters[name]
+	if !ok {
+		qc = qs.newCounter(name, qs.cfg.windowStart(now), 0)
+		qs.counters[name] = qc
+	}
+	qc.conns++
+
+	release := func() {
+		qs.mutex.Lock()
+		defer qs.mutex.Unlock()
+
+		qc.conns--
+	}
+
+	return qc, release, true
+}
+
+// Usage returns usage of all keys in the current windows. Keys without usage are skipped.
+func (qs *quotas) Usage() map[string]Usage {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	now := qs.clock.Now()
+	usage := make(map[string]Usage, len(qs.counters))
+	for name, qc := range qs.counters {
+		if u := qc.Usage(now); u.Used > 0 {
+			usage[name] = u
+		}
+	}
+
+	return usage
+}
+
+// Restore sets usage of given keys, e.g. after a restart.
+// Usage from previous windows is reset when the key is used.
+func (qs *quotas) Restore(usage map[string]Usage) {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	for name, u := range usage {
+		if qc, ok := qs.counters[name]; ok {
+			qc.restore(u)
+			continue
+		}
+
+		qs.counters[name] = qs.newCounter(name, u.WindowStart, u.Used)
+	}
+}
+
+// newCounter returns a counter of a given key with a given usage in a window with a given start.
+// It requires that mutex is held.
+func (qs *quotas) newCounter(key string, start time.Time, used int64) *quotaCounter {
+	qc := &quotaCounter{cfg: qs.cfg, start: start, used: used, key: key}
+	for _, d := range bothDirections {
+		qc.fallback[d] = qs.newLimiter(qs.cfg.fallbackConfig())
+	}
+
+	return qc
+}
+
+// sweep evicts counters without connections which usage is reset, and which fallback limiters are full.
+// It requires that mutex is held.
+func (qs *quotas) sweep(now time.Time) {
+	if now.Sub(qs.lastSweep) < sweepInterval {
+		return
+	}
+	qs.lastSweep = now
+
+	for name, qc := range qs.counters {
+		if qc.conns == 0 && qc.Used(now) == 0 &&
+			limiterIsFull(qc.fallback[readDirection], now) && limiterIsFull(qc.fallback[writeDirection], now) {
+			delete(qs.counters, name)
+		}
+	}
+}
+
+// setConfig sets a new quota at time now. It requires that mutex of quotas is held.
+func (qc *quotaCounter) setConfig(now time.Time, q Quota) {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.cfg = q
+	for _, d := range bothDirections {
+		setLimiterConfig(qc.fallback[d], now, q.fallbackConfig())
+	}
+}
+
+// Used returns a number of bytes used in a window which contains time now.
+func (qc *quotaCounter) Used(now time.Time) int64 {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.advance(now)
+
+	return qc.used
+}
+
+// Usage returns usage in a window which contains time now.
+func (qc *quotaCounter) Usage(now time.Time) Usage {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.advance(now)
+
+	return Usage{Used: qc.used, WindowStart: qc.start}
+}
+
+// restore sets given usage.
+func (qc *quotaCounter) restore(u Usage) {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.used, qc.start = u.Used, u.WindowStart
+}
+
+// ReserveN reserves up to n bytes of the quota at time now.
+// Returned reservation holds fewer bytes than n when the rest of the quota is lower.
+// When the quota is exhausted then it returns a fallback limiter, which must be used for the bytes,
+// or ErrQuotaExceeded when the quota does not have fallback.
+func (qc *quotaCounter) ReserveN(now time.Time, d direction, n int) (*Reservation, Limiter, error) {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.advance(now)
+
+	var fallback Limiter
+	remaining := qc.cfg.bytes - qc.used
+	if remaining <= 0 {
+		if qc.cfg.fallback == nil {
+			return nil, nil, ErrQuotaExceeded
+		}
+		fallback = qc.fallback[d]
+	} else if int64(n) > remaining {
+		n = int(remaining)
+	}
+
+	qc.used += int64(n)
+	start := qc.start
+	r := &Reservation{
+		tokens:    n,
+		timeToAct: now,
+		refunds: []func(n int){func(n int) {
+			qc.returnN(start, n)
+		}},
+	}
+
+	return r, fallback, nil
+}
+
+// markExceeded returns true when the quota is exhausted and it has not been reported yet
+// in a window which contains time now, so it is reported once per window.
+func (qc *quotaCounter) markExceeded(now time.Time) bool {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.advance(now)
+	if qc.exceeded || qc.used < qc.cfg.bytes {
+		return false
+	}
+	qc.exceeded = true
+
+	return true
+}
+
+// returnN returns n unused bytes, which were reserved in a window with a given start.
+// Bytes reserved in a previous window are not returned, because usage has been already reset.
+func (qc *quotaCounter) returnN(start time.Time, n int) {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	if qc.start.Equal(start) {
+		qc.used = max(qc.used-int64(n), 0)
+	}
+}
+
+// advance resets usage when a new window has started.
+// It requires that mutex is held.
+func (qc *quotaCounter) advance(now time.Time) {
+	if start := qc.cfg.windowStart(now); start.After(qc.start) {
+		qc.start = start
+		qc.used = 0
+		qc.exceeded = false
+	}
+}
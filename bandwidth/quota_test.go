@@ -0,0 +1,177 @@
+package bandwidth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindows(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	require.NoError(t, err)
+	now := time.Date(2024, time.March, 15, 23, 30, 10, 0, time.UTC)
+
+	tests := map[string]struct {
+		window Window
+		want   time.Time
+	}{
+		"every hour": {
+			window: Every(time.Hour),
+			want:   time.Date(2024, time.March, 15, 23, 0, 0, 0, time.UTC),
+		},
+		"daily in UTC": {
+			window: Daily(nil),
+			want:   time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC),
+		},
+		"daily in other location": {
+			window: Daily(warsaw),
+			want:   time.Date(2024, time.March, 16, 0, 0, 0, 0, warsaw),
+		},
+		"monthly": {
+			window: Monthly(nil),
+			want:   time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.True(t, test.want.Equal(test.window(now)), "got %v", test.window(now))
+		})
+	}
+}
+
+func TestQuotaCounterReserveN(t *testing.T) {
+	now := time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC)
+
+	t.Run("quota is exceeded", func(t *testing.T) {
+		qc := &quotaCounter{cfg: NewQuota(100, Daily(nil))}
+		r, fallback, err := qc.ReserveN(now, writeDirection, 60)
+		require.NoError(t, err)
+		assert.Nil(t, fallback)
+		assert.Equal(t, 60, r.tokens)
+
+		r, _, err = qc.ReserveN(now, readDirection, 60)
+		require.NoError(t, err)
+		assert.Equal(t, 40, r.tokens, "the rest of the quota must be reserved")
+
+		_, _, err = qc.ReserveN(now, writeDirection, 1)
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+		r.ReturnN(10)
+		assert.Equal(t, int64(90), qc.Used(now), "unused bytes must be returned")
+	})
+
+	t.Run("fallback limiter is used when quota is exceeded", func(t *testing.T) {
+		qc := &quotaCounter{cfg: NewQuota(10, Daily(nil), NewConfig(5))}
+		for _, d := range bothDirections {
+			qc.fallback[d] = newBucket(qc.cfg.fallbackConfig())
+		}
+
+		_, fallback, err := qc.ReserveN(now, writeDirection, 10)
+		require.NoError(t, err)
+		assert.Nil(t, fallback)
+
+		r, fallback, err := qc.ReserveN(now, writeDirection, 20)
+		require.NoError(t, err)
+		assert.Same(t, qc.fallback[writeDirection], fallback)
+		assert.Equal(t, 20, r.tokens)
+		assert.Equal(t, int64(30), qc.Used(now))
+	})
+
+	t.Run("usage is reset in a new window", func(t *testing.T) {
+		qc := &quotaCounter{cfg: NewQuota(100, Daily(nil)), start: Daily(nil)(now)}
+		r, _, err := qc.ReserveN(now, writeDirection, 100)
+		require.NoError(t, err)
+
+		tomorrow := now.Add(24 * time.Hour)
+		assert.Equal(t, int64(0), qc.Used(tomorrow))
+		_, _, err = qc.ReserveN(tomorrow, writeDirection, 50)
+		require.NoError(t, err)
+
+		r.ReturnN(100)
+		assert.Equal(t, int64(50), qc.Used(tomorrow), "bytes from the previous window must not be returned")
+	})
+
+	t.Run("quota without window is never reset", func(t *testing.T) {
+		qc := &quotaCounter{cfg: NewQuota(100, nil)}
+		_, _, err := qc.ReserveN(now, writeDirection, 100)
+		require.NoError(t, err)
+		assert.Equal(t, int64(100), qc.Used(now.Add(365*24*time.Hour)))
+	})
+}
+
+func TestQuotaCounters(t *testing.T) {
+	qs := newQuotas()
+	conn1 := mockAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}}
+	conn2 := mockAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}}
+
+	_, _, ok := qs.Acquire(conn1)
+	require.False(t, ok, "quotas are not enabled")
+
+	qs.key = func(conn net.Conn) string {
+		return conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	}
+	qs.SetConfig(NewQuota(100, Every(time.Hour)))
+	counter1, release1, ok := qs.Acquire(conn1)
+	require.True(t, ok)
+	counter2, release2, ok := qs.Acquire(conn2)
+	require.True(t, ok)
+	assert.Same(t, counter1, counter2, "connections with the same key must share quota")
+
+	_, _, err := counter1.ReserveN(time.Now(), writeDirection, 30)
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), qs.Used("10.0.0.1"))
+	assert.Equal(t, int64(0), qs.Used("unknown"))
+
+	// New config is applied to existing counters, and usage is kept.
+	qs.SetConfig(NewQuota(200, Every(time.Hour), NewConfig(10)))
+	assert.Equal(t, int64(200), counter1.cfg.Bytes())
+	assert.Equal(t, NewConfig(10), limiterConfig(counter1.fallback[readDirection]))
+	assert.Equal(t, int64(30), qs.Used("10.0.0.1"))
+
+	// Counter with usage is not evicted.
+	release1()
+	release2()
+	qs.mutex.Lock()
+	qs.lastSweep = time.Time{}
+	qs.sweep(time.Now())
+	qs.mutex.Unlock()
+	assert.Len(t, qs.counters, 1)
+
+	// Counter is evicted in the next window.
+	qs.mutex.Lock()
+	qs.lastSweep = time.Time{}
+	qs.sweep(time.Now().Add(time.Hour))
+	qs.mutex.Unlock()
+	assert.Empty(t, qs.counters)
+}
+
+func TestQuotaFallback(t *testing.T) {
+	_, ok := NewQuota(10, nil).Fallback()
+	assert.False(t, ok)
+
+	cfg, ok := NewQuota(10, nil, NewConfig(5)).Fallback()
+	assert.True(t, ok)
+	assert.Equal(t, NewConfig(5), cfg)
+}
+
+func TestQuotaUsage(t *testing.T) {
+	now := time.Now()
+	qs := newQuotas()
+	qs.SetConfig(NewQuota(100, Every(time.Hour)))
+	current := Every(time.Hour)(now)
+
+	qs.Restore(map[string]Usage{
+		"current": {Used: 30, WindowStart: current},
+		"old":     {Used: 50, WindowStart: current.Add(-time.Hour)},
+	})
+	assert.Equal(t, int64(30), qs.Used("current"))
+	assert.Equal(t, int64(0), qs.Used("old"), "usage from previous window must be reset")
+	assert.Equal(t, map[string]Usage{"current": {Used: 30, WindowStart: current}}, qs.Usage())
+
+	// Restored usage replaces usage of existing keys.
+	qs.Restore(map[string]Usage{"current": {Used: 10, WindowStart: current}})
+	assert.Equal(t, int64(10), qs.Used("current"))
+}
@@ -0,0 +1,83 @@
+package bandwidth
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes a connection which has been accepted by the listener and has not been closed yet.
+type ConnInfo struct {
+	// ID identifies the connection in the listener, see Conn.ID.
+	ID uint64
+	// RemoteAddr is a remote address of the connection.
+	RemoteAddr net.Addr
+	// AcceptedAt is a time when the connection was accepted.
+	AcceptedAt time.Time
+	// Class is a name of a traffic class of the connection. It is empty when the connection does not have class.
+	Class string
+	// ReadLimit and WriteLimit are current connection limits.
+	ReadLimit, WriteLimit Config
+	// Stats are traffic statistics of the connection.
+	Stats Stats
+}
+
+// connRegistry keeps open connections by their IDs.
+type connRegistry struct {
+	mutex sync.Mutex
+	conns map[uint64]*connection
+	// lastID is an ID of the last added connection. IDs start from 1.
+	lastID uint64
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[uint64]*connection),
+	}
+}
+
+// Add assigns a new ID to a given connection and keeps it until returned function is called,
+// which must be done when the connection is closed.
+func (r *connRegistry) Add(bc *connection) func() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastID++
+	bc.id = r.lastID
+	r.conns[bc.id] = bc
+
+	return func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		delete(r.conns, bc.id)
+	}
+}
+
+// Get returns an open connection with a given ID. It returns false when there is no such connection.
+func (r *connRegistry) Get(id uint64) (*connection, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bc, ok := r.conns[id]
+
+	return bc, ok
+}
+
+// All returns all open connections ordered by their IDs.
+func (r *connRegistry) All() []*connection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conns := make([]*connection, 0, len(r.conns))
+	for _, bc := range r.conns {
+		conns = append(conns, bc)
+	}
+	slices.SortFunc(conns, func(a, b *connection) int {
+		return cmp.Compare(a.id, b.id)
+	})
+
+	return conns
+}
@@ -0,0 +1,79 @@
+package bandwidth
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnections(t *testing.T) {
+	clock := newTestClock()
+	now := clock.Now()
+	ml := &mockAddrListener{addrs: []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.3:1000"}}
+	bl := NewListener(context.Background(), ml, WithClock(clock), WithClassifier(func(conn net.Conn) string {
+		if conn.RemoteAddr().String() == "10.0.0.2:1000" {
+			return "internal"
+		}
+		return ""
+	}))
+	defer bl.Close()
+	bl.SetLimits(NewUnlimitedConfig(), NewConfig(10))
+
+	first := acceptT(t, bl)
+	clock.Advance(time.Second)
+	second := acceptT(t, bl)
+	third := acceptT(t, bl)
+	writeT(t, first, newSlice(5))
+	assert.Equal(t, uint64(1), first.(Conn).ID())
+	assert.Equal(t, uint64(2), second.(Conn).ID())
+
+	// Closed connections are not listed.
+	require.NoError(t, third.Close())
+	expected := []ConnInfo{
+		{
+			ID:         1,
+			RemoteAddr: mockAddr("10.0.0.1:1000"),
+			AcceptedAt: now,
+			ReadLimit:  NewConfig(10),
+			WriteLimit: NewConfig(10),
+			Stats:      Stats{Write: DirectionStats{Bytes: 5, Rate: 1}},
+		},
+		{
+			ID:         2,
+			RemoteAddr: mockAddr("10.0.0.2:1000"),
+			AcceptedAt: now.Add(time.Second),
+			Class:      "internal",
+			ReadLimit:  NewConfig(10),
+			WriteLimit: NewConfig(10),
+		},
+	}
+	assert.Equal(t, expected, bl.Connections())
+
+	require.NoError(t, bl.SetConnLimit(2, NewConfig(100)))
+	readCfg, writeCfg := second.(Conn).Limits()
+	assert.Equal(t, NewConfig(100), readCfg)
+	assert.Equal(t, NewConfig(100), writeCfg)
+
+	// Disconnect interrupts a write which waits for the limiter.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := first.Write(newSlice(10))
+		assert.ErrorIs(t, err, net.ErrClosed)
+	}()
+	clock.BlockUntil(1)
+	require.NoError(t, bl.Disconnect(1))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "write must be interrupted by Disconnect")
+	}
+
+	assert.Len(t, bl.Connections(), 1)
+	assert.Error(t, bl.Disconnect(1))
+	assert.Error(t, bl.SetConnLimit(3, NewConfig(100)))
+}
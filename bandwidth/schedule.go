@@ -0,0 +1,167 @@
+package bandwidth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Schedule maps time ranges of a day to global and connection limits, e.g. 100 MB/s at night
+// and 5 MB/s during business hours. It drives limits of a listener created with WithSchedule option.
+type Schedule struct {
+	mutex sync.Mutex
+	loc   *time.Location
+	// globalCfg and connCfg are limits used when no rule matches.
+	globalCfg, connCfg Config
+	rules              []scheduleRule
+	// changed is closed when a rule is added, so listeners can check limits of the schedule again.
+	// It is created when it is needed.
+	changed chan struct{}
+}
+
+// scheduleRule is a time range of a day with its limits.
+type scheduleRule struct {
+	// from and to are minutes since midnight. When to is not after from, then the range ends the next day.
+	from, to int
+	// days are weekdays when the range starts. Empty days mean every day.
+	days               []time.Weekday
+	globalCfg, connCfg Config
+}
+
+// NewSchedule returns a schedule in a given location, which uses given limits when no rule matches.
+// Nil location means UTC.
+func NewSchedule(loc *time.Location, globalCfg, connCfg Config) *Schedule {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return &Schedule{
+		loc:       loc,
+		globalCfg: globalCfg,
+		connCfg:   connCfg,
+	}
+}
+
+// Add adds a rule with limits for a time range from "15:04" to "15:04" on given weekdays.
+// Range which ends before it starts, e.g. from "22:00" to "06:00", ends the next day,
+// and range which ends when it starts lasts the whole day. Weekdays are days when the range starts,
+// and no weekdays mean every day. Rules are checked in order in which they have been added.
+// Rules can be added while a listener follows the schedule.
+func (s *Schedule) Add(from, to string, globalCfg, connCfg Config, days ...time.Weekday) error {
+	fromMinutes, err := parseTimeOfDay(from)
+	if err != nil {
+		return err
+	}
+	toMinutes, err := parseTimeOfDay(to)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rules = append(s.rules, scheduleRule{
+		from:      fromMinutes,
+		to:        toMinutes,
+		days:      days,
+		globalCfg: globalCfg,
+		connCfg:   connCfg,
+	})
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+
+	return nil
+}
+
+// changes returns a channel, which is closed when a rule is added.
+func (s *Schedule) changes() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+
+	return s.changed
+}
+
+// Limits returns global and connection limits at a given time.
+func (s *Schedule) Limits(t time.Time) (Config, Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, rule := range s.rules {
+		// Range could start yesterday and end today.
+		for _, day := range []int{0, -1} {
+			start, end := rule.occurrence(t, day, s.loc)
+			if rule.matchesDay(start.Weekday()) && !t.Before(start) && t.Before(end) {
+				return rule.globalCfg, rule.connCfg
+			}
+		}
+	}
+
+	return s.globalCfg, s.connCfg
+}
+
+// Next returns the first time after a given time, when limits can change.
+func (s *Schedule) Next(t time.Time) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	local := t.In(s.loc)
+	// Weekday changes at midnight, so rules for other days can start matching.
+	next := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, s.loc)
+	for _, rule := range s.rules {
+		for _, day := range []int{-1, 0, 1} {
+			start, end := rule.occurrence(t, day, s.loc)
+			for _, candidate := range []time.Time{start, end} {
+				if candidate.After(t) && candidate.Before(next) {
+					next = candidate
+				}
+			}
+		}
+	}
+
+	return next
+}
+
+// occurrence returns the start and the end of the rule's range, which starts a given number of days
+// after the day of a given time.
+func (r scheduleRule) occurrence(t time.Time, day int, loc *time.Location) (time.Time, time.Time) {
+	local := t.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day()+day, 0, r.from, 0, 0, loc)
+	endDay := local.Day() + day
+	if r.to <= r.from {
+		endDay++
+	}
+	end := time.Date(local.Year(), local.Month(), endDay, 0, r.to, 0, 0, loc)
+
+	return start, end
+}
+
+// matchesDay returns true when the rule's range can start on a given weekday.
+func (r scheduleRule) matchesDay(weekday time.Weekday) bool {
+	if len(r.days) == 0 {
+		return true
+	}
+
+	for _, day := range r.days {
+		if day == weekday {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTimeOfDay returns minutes since midnight of a time in "15:04" format.
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("bandwidth: invalid time of day %q: %w", value, err)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
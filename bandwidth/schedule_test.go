@@ -0,0 +1,88 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleLimits(t *testing.T) {
+	// 2024-03-15 is Friday.
+	day := func(d, hour, minute int) time.Time {
+		return time.Date(2024, time.March, d, hour, minute, 0, 0, time.UTC)
+	}
+	night, business, weekend := NewConfig(100), NewConfig(5), NewConfig(50)
+	s := NewSchedule(nil, NewConfig(10), NewConfig(1))
+	require.NoError(t, s.Add("22:00", "06:00", night, NewConfig(10)))
+	require.NoError(t, s.Add("09:00", "17:00", business, NewConfig(1), time.Monday, time.Tuesday,
+		time.Wednesday, time.Thursday, time.Friday))
+	require.NoError(t, s.Add("00:00", "00:00", weekend, NewConfig(5), time.Saturday, time.Sunday))
+
+	tests := map[string]struct {
+		t          time.Time
+		wantGlobal Config
+	}{
+		"business hours":                   {t: day(15, 9, 0), wantGlobal: business},
+		"end of business hours":            {t: day(15, 17, 0), wantGlobal: NewConfig(10)},
+		"night starts":                     {t: day(14, 22, 0), wantGlobal: night},
+		"night continues after midnight":   {t: day(15, 5, 59), wantGlobal: night},
+		"night continues on weekend":       {t: day(16, 1, 0), wantGlobal: night},
+		"weekend":                          {t: day(16, 12, 0), wantGlobal: weekend},
+		"business hours are not weekend":   {t: day(17, 10, 0), wantGlobal: weekend},
+		"default limits between the rules": {t: day(15, 7, 0), wantGlobal: NewConfig(10)},
+	}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			globalCfg, _ := s.Limits(test.t)
+			assert.Equal(t, test.wantGlobal, globalCfg)
+		})
+	}
+}
+
+func TestScheduleLocation(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(t, err)
+	s := NewSchedule(tokyo, NewConfig(10), NewConfig(1))
+	require.NoError(t, s.Add("22:00", "06:00", NewConfig(100), NewConfig(10)))
+
+	// 14:00 UTC is 23:00 in Tokyo.
+	globalCfg, connCfg := s.Limits(time.Date(2024, time.March, 15, 14, 0, 0, 0, time.UTC))
+	assert.Equal(t, NewConfig(100), globalCfg)
+	assert.Equal(t, NewConfig(10), connCfg)
+}
+
+func TestScheduleNext(t *testing.T) {
+	s := NewSchedule(nil, NewConfig(10), NewConfig(1))
+	require.NoError(t, s.Add("22:00", "06:00", NewConfig(100), NewConfig(10)))
+	require.NoError(t, s.Add("09:00", "17:00", NewConfig(5), NewConfig(1), time.Friday))
+
+	now := time.Date(2024, time.March, 15, 7, 0, 0, 0, time.UTC)
+	next := s.Next(now)
+	assert.Equal(t, time.Date(2024, time.March, 15, 9, 0, 0, 0, time.UTC), next)
+	next = s.Next(next)
+	assert.Equal(t, time.Date(2024, time.March, 15, 17, 0, 0, 0, time.UTC), next)
+	next = s.Next(next)
+	assert.Equal(t, time.Date(2024, time.March, 15, 22, 0, 0, 0, time.UTC), next)
+	next = s.Next(next)
+	assert.Equal(t, time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC), next, "weekday changes at midnight")
+	next = s.Next(next)
+	assert.Equal(t, time.Date(2024, time.March, 16, 6, 0, 0, 0, time.UTC), next)
+}
+
+func TestScheduleAdd(t *testing.T) {
+	s := NewSchedule(nil, NewConfig(10), NewConfig(1))
+	assert.Error(t, s.Add("25:00", "06:00", NewConfig(100), NewConfig(10)))
+	assert.Error(t, s.Add("22:00", "6am", NewConfig(100), NewConfig(10)))
+	assert.Empty(t, s.rules)
+
+	changed := s.changes()
+	require.NoError(t, s.Add("22:00", "06:00", NewConfig(100), NewConfig(10)))
+	select {
+	case <-changed:
+	default:
+		assert.Fail(t, "adding a rule must be signaled")
+	}
+	assert.NotEqual(t, changed, s.changes())
+}
@@ -0,0 +1,202 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often sources are checked whether they can be evicted.
+const sweepInterval = time.Second
+
+// sourceLimiters keeps limiters which are shared by connections from the same source.
+// Source is a remote IP address or a subnet of a remote IP address.
+type sourceLimiters struct {
+	mutex sync.Mutex
+	// enabled is true when connections should be grouped by sources.
+	enabled bool
+	// ipv4Bits and ipv6Bits are prefix lengths of a subnet which groups connections.
+	ipv4Bits, ipv6Bits int
+	// cfg is a limit config for each source per direction.
+	cfg     [directions]Config
+	sources map[netip.Prefix]*source
+	// lastSweep is a time when idle sources were evicted last time.
+	lastSweep time.Time
+	// clock tells the time when limiters are changed and sources are evicted.
+	clock Clock
+	// newLimiter creates limiters of new sources.
+	newLimiter LimiterFactory
+}
+
+// source keeps limiters for one source.
+type source struct {
+	limiter [directions]Limiter
+	// conns is a number of open connections from the source.
+	conns int
+}
+
+// newSourceLimiters returns unlimited source limiters.
+// Sources are not used until prefix lengths are set by enable.
+func newSourceLimiters() *sourceLimiters {
+	unlimited := NewUnlimitedConfig()
+
+	return &sourceLimiters{
+		cfg:        [directions]Config{unlimited, unlimited},
+		sources:    make(map[netip.Prefix]*source),
+		clock:      systemClock{},
+		newLimiter: newBucketLimiter,
+	}
+}
+
+// enable groups connections by sources with given prefix lengths.
+func (sl *sourceLimiters) enable(ipv4Bits, ipv6Bits int) {
+	if ipv4Bits < 0 || ipv4Bits > 32 {
+		panic(fmt.Sprintf("invalid IPv4 prefix length %d", ipv4Bits))
+	}
+	if ipv6Bits < 0 || ipv6Bits > 128 {
+		panic(fmt.Sprintf("invalid IPv6 prefix length %d", ipv6Bits))
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	sl.enabled = true
+	sl.ipv4Bits, sl.ipv6Bits = ipv4Bits, ipv6Bits
+}
+
+// Config returns limit config for each source per direction.
+func (sl *sourceLimiters) Config() [directions]Config {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	return sl.cfg
+}
+
+// SetConfig sets limit config for each source in given directions.
+// Existing sources get new config immediately.
+func (sl *sourceLimiters) SetConfig(cfg Config, dirs ...direction) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	cfg = orUnlimited(cfg)
+	now := sl.clock.Now()
+	for _, d := range dirs {
+		sl.cfg[d] = cfg
+		for _, s := range sl.sources {
+			setLimiterConfig(s.limiter[d], now, cfg)
+		}
+	}
+}
+
+// Acquire returns limiters of a source for a given connection.
+// Returned function must be called when the connection is closed.
+// It returns false when sources are not enabled or the connection's remote address does not have IP address.
+func (sl *sourceLimiters) Acquire(conn net.Conn) ([directions]Limiter, func(), bool) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if !sl.enabled {
+		return [directions]Limiter{}, nil, false
+	}
+
+	prefix, ok := sourcePrefix(conn.RemoteAddr(), sl.ipv4Bits, sl.ipv6Bits)
+	if !ok {
+		return [directions]Limiter{}, nil, false
+	}
+
+	now := sl.clock.Now()
+	sl.sweep(now)
+
+	s, ok := sl.sources[prefix]
+	if !ok {
+		s = &source{}
+		for _, d := range bothDirections {
+			s.limiter[d] = sl.newLimiter(sl.cfg[d])
+		}
+		sl.sources[prefix] = s
+	}
+	s.conns++
+
+	release := func() {
+		sl.mutex.Lock()
+		defer sl.mutex.Unlock()
+
+		s.conns--
+	}
+
+	return s.limiter, release, true
+}
+
+// Len returns number of sources which are kept in memory.
+func (sl *sourceLimiters) Len() int {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	return len(sl.sources)
+}
+
+// sweep evicts sources without connections which limiters are full.
+// Such limiters are the same as new ones, so reconnecting clients can not get more bytes.
+// It requires that mutex is held.
+func (sl *sourceLimiters) sweep(now time.Time) {
+	if now.Sub(sl.lastSweep) < sweepInterval {
+		return
+	}
+	sl.lastSweep = now
+
+	for prefix, s := range sl.sources {
+		if s.conns == 0 &&
+			limiterIsFull(s.limiter[readDirection], now) && limiterIsFull(s.limiter[writeDirection], now) {
+			delete(sl.sources, prefix)
+		}
+	}
+}
+
+// sourcePrefix returns subnet of a given address.
+func sourcePrefix(addr net.Addr, ipv4Bits, ipv6Bits int) (netip.Prefix, bool) {
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+
+	bits := ipv6Bits
+	if ip.Is4() {
+		bits = ipv4Bits
+	}
+
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return prefix, true
+}
+
+// remoteIP returns IP address of a given address without zone. IPv4-mapped IPv6 addresses are returned as IPv4.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	default:
+		addrPort, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = addrPort.Addr()
+	}
+
+	if !ip.IsValid() {
+		return netip.Addr{}, false
+	}
+
+	return ip.Unmap().WithZone(""), true
+}
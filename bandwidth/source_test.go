@@ -0,0 +1,160 @@
+package bandwidth
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourcePrefix(t *testing.T) {
+	tests := map[string]struct {
+		addr     net.Addr
+		ipv4Bits int
+		ipv6Bits int
+		want     string
+		wantOK   bool
+	}{
+		"IPv4 address": {
+			addr:     &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 80},
+			ipv4Bits: 32,
+			ipv6Bits: 128,
+			want:     "192.168.1.10/32",
+			wantOK:   true,
+		},
+		"IPv4 subnet": {
+			addr:     &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 80},
+			ipv4Bits: 24,
+			ipv6Bits: 64,
+			want:     "192.168.1.0/24",
+			wantOK:   true,
+		},
+		"IPv6 subnet": {
+			addr:     &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 80},
+			ipv4Bits: 24,
+			ipv6Bits: 64,
+			want:     "2001:db8:1:2::/64",
+			wantOK:   true,
+		},
+		"IPv4 mapped to IPv6": {
+			addr:     &net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 80},
+			ipv4Bits: 8,
+			ipv6Bits: 64,
+			want:     "10.0.0.0/8",
+			wantOK:   true,
+		},
+		"UDP address": {
+			addr:     &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+			ipv4Bits: 32,
+			ipv6Bits: 128,
+			want:     "10.0.0.1/32",
+			wantOK:   true,
+		},
+		"other address": {
+			addr:     mockAddr("10.0.0.1:80"),
+			ipv4Bits: 32,
+			ipv6Bits: 128,
+			want:     "10.0.0.1/32",
+			wantOK:   true,
+		},
+		"unix socket": {
+			addr:     &net.UnixAddr{Name: "/tmp/socket", Net: "unix"},
+			ipv4Bits: 32,
+			ipv6Bits: 128,
+		},
+		"no address": {
+			ipv4Bits: 32,
+			ipv6Bits: 128,
+		},
+	}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			prefix, ok := sourcePrefix(test.addr, test.ipv4Bits, test.ipv6Bits)
+			require.Equal(t, test.wantOK, ok)
+			if test.wantOK {
+				assert.Equal(t, netip.MustParsePrefix(test.want), prefix)
+			}
+		})
+	}
+}
+
+func TestSourceLimiters(t *testing.T) {
+	sl := newSourceLimiters()
+	conn1 := mockAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}}
+	conn2 := mockAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}}
+	conn3 := mockAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.1.1")}}
+
+	_, _, ok := sl.Acquire(conn1)
+	require.False(t, ok, "sources are not enabled")
+
+	sl.enable(24, 64)
+	sl.SetConfig(NewConfig(10), bothDirections...)
+	limiter1, release1, ok := sl.Acquire(conn1)
+	require.True(t, ok)
+	limiter2, release2, ok := sl.Acquire(conn2)
+	require.True(t, ok)
+	limiter3, release3, ok := sl.Acquire(conn3)
+	require.True(t, ok)
+	assert.Same(t, limiter1[readDirection], limiter2[readDirection], "the same subnet must share limiters")
+	assert.NotSame(t, limiter1[readDirection], limiter3[readDirection])
+	assert.NotSame(t, limiter1[readDirection], limiter1[writeDirection])
+	assert.Equal(t, 2, sl.Len())
+
+	// New config is applied to existing sources.
+	sl.SetConfig(NewConfig(20), writeDirection)
+	assert.Equal(t, NewConfig(10), limiterConfig(limiter1[readDirection]))
+	assert.Equal(t, NewConfig(20), limiterConfig(limiter1[writeDirection]))
+	assert.Equal(t, [directions]Config{NewConfig(10), NewConfig(20)}, sl.Config())
+
+	// Source with connections is not evicted.
+	_, err := limiter1[readDirection].ReserveN(time.Now(), 10)
+	require.NoError(t, err)
+	release1()
+	release3()
+	sl.mutex.Lock()
+	sl.sweep(time.Now().Add(time.Hour))
+	sl.mutex.Unlock()
+	assert.Equal(t, 1, sl.Len())
+
+	// Source without connections is not evicted until its limiters are full.
+	release2()
+	sl.mutex.Lock()
+	sl.sweep(time.Now().Add(time.Hour))
+	sl.mutex.Unlock()
+	assert.Equal(t, 1, sl.Len(), "sweep must not be run too often")
+
+	sl.mutex.Lock()
+	sl.lastSweep = time.Time{}
+	sl.sweep(time.Now())
+	sl.mutex.Unlock()
+	assert.Equal(t, 1, sl.Len(), "limiter is not full")
+
+	sl.mutex.Lock()
+	sl.lastSweep = time.Time{}
+	sl.sweep(time.Now().Add(2 * time.Second))
+	sl.mutex.Unlock()
+	assert.Equal(t, 0, sl.Len(), "limiter is full")
+}
+
+func TestSourceLimitersInvalidPrefix(t *testing.T) {
+	assert.Panics(t, func() {
+		newSourceLimiters().enable(33, 64)
+	})
+	assert.Panics(t, func() {
+		newSourceLimiters().enable(24, -1)
+	})
+}
+
+// mockAddr is an address which is neither TCP nor UDP address.
+type mockAddr string
+
+func (mockAddr) Network() string {
+	return "mock"
+}
+
+func (a mockAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,182 @@
+package bandwidth
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateTimeConstant is a time constant of the moving average of effective rate.
+// Older bytes count less with each time constant, so the rate follows changes within a few of them.
+const rateTimeConstant = 5 * time.Second
+
+// waitBuckets are upper bounds of buckets of the histogram of waits for limiters.
+var waitBuckets = [...]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// Stats is a snapshot of traffic statistics of a connection or all connections of a listener.
+type Stats struct {
+	Read  DirectionStats
+	Write DirectionStats
+}
+
+// DirectionStats is a snapshot of traffic statistics in one direction.
+type DirectionStats struct {
+	// Bytes is a number of bytes which have been transferred.
+	Bytes int64
+	// Waits is a number of times when bytes have not been allowed immediately by limiters.
+	Waits int64
+	// WaitTime is a total time spent waiting for limiters.
+	WaitTime time.Duration
+	// MaxWait is the longest single wait for limiters.
+	MaxWait time.Duration
+	// Rate is an effective rate in bytes per second, which is an exponential moving average over the last seconds.
+	Rate float64
+}
+
+// ListenerStats is a snapshot of traffic statistics of a listener.
+type ListenerStats struct {
+	// Stats are statistics of all connections accepted by the listener, including closed ones.
+	Stats
+	// Accepted is a number of accepted connections.
+	Accepted int64
+	// Active is a number of accepted connections which have not been closed yet.
+	Active int64
+}
+
+// traffic counts traffic and connections of a group of connections, e.g. a traffic class.
+type traffic struct {
+	stats [directions]trafficStats
+	// accepted and active are numbers of accepted connections and connections which have not been closed yet.
+	accepted, active atomic.Int64
+	// parent counts the same traffic and connections, e.g. all connections of the listener. It is nil for the listener.
+	parent *traffic
+}
+
+// setParent sets a group which gets the same traffic and connections.
+func (t *traffic) setParent(parent *traffic) {
+	t.parent = parent
+	for _, d := range bothDirections {
+		t.stats[d].parent = &parent.stats[d]
+	}
+}
+
+// attach counts traffic of a given connection into the group.
+// Returned function must be called when the connection is closed.
+func (t *traffic) attach(bc *connection) func() {
+	for _, d := range bothDirections {
+		bc.stats[d].parent = &t.stats[d]
+	}
+	for g := t; g != nil; g = g.parent {
+		g.accepted.Add(1)
+		g.active.Add(1)
+	}
+
+	return func() {
+		for g := t; g != nil; g = g.parent {
+			g.active.Add(-1)
+		}
+	}
+}
+
+// Snapshot returns statistics of the group at time now.
+func (t *traffic) Snapshot(now time.Time) ListenerStats {
+	return ListenerStats{
+		Stats: Stats{
+			Read:  t.stats[readDirection].Snapshot(now),
+			Write: t.stats[writeDirection].Snapshot(now),
+		},
+		Accepted: t.accepted.Load(),
+		Active:   t.active.Load(),
+	}
+}
+
+// trafficStats counts traffic in one direction. It is safe for concurrent use.
+type trafficStats struct {
+	mutex sync.Mutex
+	stats DirectionStats
+	// waits are numbers of waits in buckets of the histogram, which are not cumulative.
+	// Waits longer than the last bucket are counted only in the total number of waits.
+	waits [len(waitBuckets)]int64
+	// last is a time when rate was updated last time.
+	last time.Time
+	// parent gets the same traffic, e.g. statistics of the listener for a connection. It is nil for the listener.
+	parent *trafficStats
+}
+
+// addBytes counts n bytes transferred at time now.
+func (s *trafficStats) addBytes(now time.Time, n int) {
+	if n <= 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	s.stats.Bytes += int64(n)
+	s.stats.Rate = s.rateAt(now) + float64(n)/rateTimeConstant.Seconds()
+	if now.After(s.last) {
+		s.last = now
+	}
+	s.mutex.Unlock()
+
+	if s.parent != nil {
+		s.parent.addBytes(now, n)
+	}
+}
+
+// addWait counts one wait for limiters which took a given duration.
+func (s *trafficStats) addWait(d time.Duration) {
+	s.mutex.Lock()
+	s.stats.Waits++
+	s.stats.WaitTime += d
+	s.stats.MaxWait = max(s.stats.MaxWait, d)
+	for i, bound := range waitBuckets {
+		if d <= bound {
+			s.waits[i]++
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	if s.parent != nil {
+		s.parent.addWait(d)
+	}
+}
+
+// Snapshot returns statistics at time now.
+func (s *trafficStats) Snapshot(now time.Time) DirectionStats {
+	stats, _ := s.Histogram(now)
+
+	return stats
+}
+
+// Histogram returns statistics at time now together with cumulative numbers of waits
+// which are not longer than bounds of waitBuckets, so both are consistent.
+func (s *trafficStats) Histogram(now time.Time) (DirectionStats, [len(waitBuckets)]int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := s.stats
+	stats.Rate = s.rateAt(now)
+
+	var cumulative [len(waitBuckets)]int64
+	var count int64
+	for i, n := range s.waits {
+		count += n
+		cumulative[i] = count
+	}
+
+	return stats, cumulative
+}
+
+// rateAt returns the rate decayed until time now. It requires that mutex is held.
+func (s *trafficStats) rateAt(now time.Time) float64 {
+	if !now.After(s.last) {
+		return s.stats.Rate
+	}
+
+	return s.stats.Rate * math.Exp(-now.Sub(s.last).Seconds()/rateTimeConstant.Seconds())
+}
@@ -0,0 +1,34 @@
+package bandwidth
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficStats(t *testing.T) {
+	now := time.Now()
+	parent := &trafficStats{}
+	s := &trafficStats{parent: parent}
+
+	s.addBytes(now, 10)
+	s.addBytes(now, 0)
+	s.addWait(time.Second)
+	s.addWait(3 * time.Second)
+	s.addWait(2 * time.Second)
+
+	expected := DirectionStats{Bytes: 10, Waits: 3, WaitTime: 6 * time.Second, MaxWait: 3 * time.Second, Rate: 2}
+	assert.Equal(t, expected, s.Snapshot(now))
+	assert.Equal(t, expected, parent.Snapshot(now))
+
+	// The rate decays by e every time constant, and a snapshot does not change it.
+	assert.InDelta(t, 2/math.E, s.Snapshot(now.Add(rateTimeConstant)).Rate, 1e-9)
+	assert.InDelta(t, 2/math.E/math.E, s.Snapshot(now.Add(2*rateTimeConstant)).Rate, 1e-9)
+
+	// Bytes which are counted out of order do not decay the rate backwards.
+	s.addBytes(now.Add(-time.Second), 5)
+	assert.InDelta(t, 3, s.Snapshot(now).Rate, 1e-9)
+	assert.Equal(t, int64(15), s.Snapshot(now).Bytes)
+}
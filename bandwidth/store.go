@@ -0,0 +1,128 @@
+package bandwidth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage is a number of bytes used by a quota key in a window.
+type Usage struct {
+	Used int64 `json:"used"`
+	// WindowStart is the start of a window, when bytes were used.
+	WindowStart time.Time `json:"windowStart"`
+}
+
+// Store keeps usage of quota keys, so it survives restarts of the listener.
+type Store interface {
+	// Load returns usage of all keys. It returns empty usage when nothing has been saved yet.
+	Load() (map[string]Usage, error)
+	// Save replaces saved usage of all keys.
+	Save(usage map[string]Usage) error
+}
+
+// MemoryStore is a store which keeps usage in memory.
+// It can be shared by listeners which are created one after another in the same process.
+type MemoryStore struct {
+	mutex sync.Mutex
+	usage map[string]Usage
+}
+
+// NewMemoryStore returns an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{usage: make(map[string]Usage)}
+}
+
+// Load returns usage of all keys.
+func (ms *MemoryStore) Load() (map[string]Usage, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return copyUsage(ms.usage), nil
+}
+
+// Save replaces saved usage of all keys.
+func (ms *MemoryStore) Save(usage map[string]Usage) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.usage = copyUsage(usage)
+
+	return nil
+}
+
+func copyUsage(usage map[string]Usage) map[string]Usage {
+	result := make(map[string]Usage, len(usage))
+	for key, u := range usage {
+		result[key] = u
+	}
+
+	return result
+}
+
+// FileStore is a store which keeps a JSON snapshot of usage in a file.
+// Snapshot is written into a temporary file which replaces the old one, so the file is never half-written.
+type FileStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileStore returns a store which keeps usage in a file with a given path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load returns usage of all keys. It returns empty usage when the file does not exist.
+func (fs *FileStore) Load() (map[string]Usage, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	usage := make(map[string]Usage)
+	data, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth: failed to read usage: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("bandwidth: failed to decode usage from %q: %w", fs.path, err)
+	}
+
+	return usage, nil
+}
+
+// Save replaces saved usage of all keys.
+func (fs *FileStore) Save(usage map[string]Usage) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("bandwidth: failed to encode usage: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("bandwidth: failed to save usage: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("bandwidth: failed to save usage: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("bandwidth: failed to save usage: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return fmt.Errorf("bandwidth: failed to save usage: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package bandwidth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ms := NewMemoryStore()
+	usage, err := ms.Load()
+	require.NoError(t, err)
+	assert.Empty(t, usage)
+
+	start := time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)
+	saved := map[string]Usage{"10.0.0.1": {Used: 100, WindowStart: start}}
+	require.NoError(t, ms.Save(saved))
+	saved["10.0.0.2"] = Usage{Used: 1}
+
+	usage, err = ms.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Usage{"10.0.0.1": {Used: 100, WindowStart: start}}, usage, "saved usage must be copied")
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "usage.json")
+	fs := NewFileStore(path)
+
+	usage, err := fs.Load()
+	require.NoError(t, err, "file which does not exist means empty usage")
+	assert.Empty(t, usage)
+
+	start := time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)
+	saved := map[string]Usage{
+		"10.0.0.1": {Used: 100, WindowStart: start},
+		"10.0.0.2": {Used: 5, WindowStart: start},
+	}
+	require.NoError(t, fs.Save(saved))
+	require.NoError(t, fs.Save(saved), "file must be replaced")
+
+	usage, err = NewFileStore(path).Load()
+	require.NoError(t, err)
+	assert.Equal(t, saved, usage)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be removed")
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err = fs.Load()
+	assert.Error(t, err)
+
+	assert.Error(t, NewFileStore(filepath.Join(dir, "unknown", "usage.json")).Save(saved))
+}
@@ -0,0 +1,204 @@
+package bandwidth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/time/rate"
+)
+
+// unit is a unit of data with its size in bytes.
+type unit struct {
+	name  string
+	bytes float64
+}
+
+// formatUnits are units used to format sizes, from the largest one.
+// IEC units go before SI units of the same magnitude, because they are more common for limits.
+var formatUnits = []unit{
+	{"TiB", 1 << 40}, {"TB", 1e12},
+	{"GiB", 1 << 30}, {"GB", 1e9},
+	{"MiB", 1 << 20}, {"MB", 1e6},
+	{"KiB", 1 << 10}, {"kB", 1e3},
+}
+
+// parseUnits are sizes in bytes of units accepted by ParseConfig.
+var parseUnits = map[string]float64{
+	"B": 1, "bit": 1.0 / 8,
+	"kB": 1e3, "KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+	"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40,
+	"kbit": 1e3 / 8, "Kbit": 1e3 / 8, "Mbit": 1e6 / 8, "Gbit": 1e9 / 8, "Tbit": 1e12 / 8,
+	"Kibit": (1 << 10) / 8, "Mibit": (1 << 20) / 8, "Gibit": (1 << 30) / 8, "Tibit": (1 << 40) / 8,
+}
+
+// unlimited is a text of an unlimited config.
+const unlimited = "unlimited"
+
+// ParseConfig returns a config for a text like "10MiB/s", "800kbit/s" or "5MB/s burst 1MB".
+// Sizes can use SI units (kB, MB, GB, TB), IEC units (KiB, MiB, GiB, TiB), and bits instead of bytes (kbit, Mibit, ...).
+// Burst is optional, and algorithm can be given at the end, e.g. "1MB/s algorithm leaky-bucket".
+// Text "unlimited" returns an unlimited config. Config.String returns a text which is parsed into the same config.
+func ParseConfig(text string) (Config, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return Config{}, errors.New("bandwidth: empty limit")
+	}
+
+	var c Config
+	rest := fields[1:]
+	if fields[0] == unlimited {
+		c = NewUnlimitedConfig()
+	} else {
+		var limit float64
+		var err error
+		limit, rest, err = parseSize(fields, "/s")
+		if err != nil {
+			return Config{}, fmt.Errorf("bandwidth: invalid limit %q: %w", text, err)
+		}
+
+		var burst []int
+		if len(rest) > 0 && rest[0] == "burst" {
+			var size float64
+			size, rest, err = parseSize(rest[1:], "")
+			if err != nil {
+				return Config{}, fmt.Errorf("bandwidth: invalid burst in %q: %w", text, err)
+			}
+			if size != math.Trunc(size) || size > math.MaxInt {
+				return Config{}, fmt.Errorf("bandwidth: invalid burst in %q: it must be a whole number of bytes", text)
+			}
+			burst = append(burst, int(size))
+		}
+
+		c = NewConfig(rate.Limit(limit), burst...)
+	}
+
+	if len(rest) > 0 && rest[0] == "algorithm" {
+		if len(rest) < 2 {
+			return Config{}, fmt.Errorf("bandwidth: missing algorithm in %q", text)
+		}
+
+		algorithm, err := parseAlgorithm(rest[1])
+		if err != nil {
+			return Config{}, err
+		}
+		c = c.WithAlgorithm(algorithm)
+		rest = rest[2:]
+	}
+
+	if len(rest) > 0 {
+		return Config{}, fmt.Errorf("bandwidth: unexpected %q in limit %q", strings.Join(rest, " "), text)
+	}
+
+	return c, nil
+}
+
+// parseSize parses a positive size with a unit and a given suffix from the beginning of fields,
+// e.g. "10MiB/s" or "10 MiB/s". It returns the size in bytes and remaining fields.
+func parseSize(fields []string, suffix string) (float64, []string, error) {
+	if len(fields) == 0 {
+		return 0, nil, errors.New("missing size")
+	}
+
+	text, rest := fields[0], fields[1:]
+	if !strings.ContainsFunc(text, unicode.IsLetter) && len(rest) > 0 {
+		// Number and unit are separated by a space.
+		text, rest = text+rest[0], rest[1:]
+	}
+
+	i := strings.IndexFunc(text, unicode.IsLetter)
+	if i < 0 {
+		return 0, nil, fmt.Errorf("missing unit in %q", text)
+	}
+
+	value, err := strconv.ParseFloat(text[:i], 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid number %q", text[:i])
+	}
+	if value <= 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, nil, fmt.Errorf("%q must be positive", text[:i])
+	}
+
+	name, ok := strings.CutSuffix(text[i:], suffix)
+	if !ok {
+		return 0, nil, fmt.Errorf("missing %q in %q", suffix, text)
+	}
+	bytes, ok := parseUnits[name]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown unit %q", name)
+	}
+
+	return value * bytes, rest, nil
+}
+
+// parseAlgorithm returns an algorithm with a given name.
+func parseAlgorithm(name string) (Algorithm, error) {
+	for _, algorithm := range []Algorithm{TokenBucket, LeakyBucket, SlidingWindow} {
+		if algorithm.String() == name {
+			return algorithm, nil
+		}
+	}
+
+	return 0, fmt.Errorf("bandwidth: unknown algorithm %q", name)
+}
+
+// formatSize returns a size in bytes with the largest unit which represents it exactly.
+func formatSize(bytes float64) string {
+	for _, u := range formatUnits {
+		if value := bytes / u.bytes; value >= 1 && value == math.Trunc(value) {
+			return strconv.FormatFloat(value, 'f', -1, 64) + u.name
+		}
+	}
+
+	return strconv.FormatFloat(bytes, 'f', -1, 64) + "B"
+}
+
+// String returns the config in a format parsed by ParseConfig, e.g. "10MiB/s burst 1MiB".
+// Burst is omitted when it is the default one. Zero Config is a missing limit, so its text is empty.
+func (c Config) String() string {
+	if c == (Config{}) {
+		return ""
+	}
+
+	var b strings.Builder
+	if c.limit == rate.Inf {
+		b.WriteString(unlimited)
+	} else {
+		b.WriteString(formatSize(float64(c.limit)) + "/s")
+		if !c.IsTheSame(NewConfig(c.limit).WithAlgorithm(c.algorithm)) {
+			b.WriteString(" burst " + formatSize(float64(c.burst)))
+		}
+	}
+
+	if c.algorithm != TokenBucket {
+		b.WriteString(" algorithm " + c.algorithm.String())
+	}
+
+	return b.String()
+}
+
+// MarshalText returns the config in a format parsed by ParseConfig.
+func (c Config) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText sets the config parsed from a text by ParseConfig. Empty text is a missing limit, which is zero Config.
+func (c *Config) UnmarshalText(text []byte) error {
+	if len(bytes.TrimSpace(text)) == 0 {
+		*c = Config{}
+		return nil
+	}
+
+	parsed, err := ParseConfig(string(text))
+	if err != nil {
+		return err
+	}
+
+	*c = parsed
+
+	return nil
+}
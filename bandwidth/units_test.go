@@ -0,0 +1,93 @@
+package bandwidth
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := map[string]Config{
+		"10MiB/s":                      NewConfig(10 << 20),
+		"10 MiB/s":                     NewConfig(10 << 20),
+		"800kbit/s":                    NewConfig(100000),
+		"1Gibit/s":                     NewConfig(1 << 27),
+		"5MB/s burst 1MB":              NewConfig(5000000, 1000000),
+		"5 MB/s burst 1 MB":            NewConfig(5000000, 1000000),
+		"1.5KiB/s":                     NewConfig(1536),
+		"100B/s burst 8kbit":           NewConfig(100, 1000),
+		"unlimited":                    NewUnlimitedConfig(),
+		"1MB/s algorithm leaky-bucket": NewConfig(1000000).WithAlgorithm(LeakyBucket),
+		"1MB/s burst 1KiB algorithm sliding-window": NewConfig(1000000, 1024).WithAlgorithm(SlidingWindow),
+	}
+	for text, want := range tests {
+		t.Run(text, func(t *testing.T) {
+			c, err := ParseConfig(text)
+			require.NoError(t, err)
+			assert.Equal(t, want, c)
+		})
+	}
+
+	for _, text := range []string{
+		"", "10", "10MiB", "10XB/s", "-1MB/s", "0B/s", "abcMB/s", "10MB/s burst", "10MB/s burst 0B",
+		"10MB/s burst 1bit", "10MB/s algorithm", "10MB/s algorithm unknown", "10MB/s extra",
+	} {
+		_, err := ParseConfig(text)
+		assert.Error(t, err, "text %q must be invalid", text)
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	tests := map[string]Config{
+		"10MiB/s":                       NewConfig(10 << 20),
+		"100kB/s":                       NewConfig(100000),
+		"5MB/s burst 1MB":               NewConfig(5000000, 1000000),
+		"1.5B/s":                        NewConfig(1.5),
+		"1500B/s":                       NewConfig(1500),
+		"unlimited":                     NewUnlimitedConfig(),
+		"1KiB/s algorithm leaky-bucket": NewConfig(1024).WithAlgorithm(LeakyBucket),
+	}
+	for want, c := range tests {
+		t.Run(want, func(t *testing.T) {
+			assert.Equal(t, want, c.String())
+
+			parsed, err := ParseConfig(c.String())
+			require.NoError(t, err)
+			assert.Equal(t, c, parsed, "string must be parsed into the same config")
+		})
+	}
+}
+
+func TestConfigText(t *testing.T) {
+	type limits struct {
+		Global Config  `json:"global"`
+		Conn   *Config `json:"conn"`
+	}
+
+	l := limits{Global: NewConfig(10<<20, 1<<20), Conn: &Config{}}
+	*l.Conn = NewConfig(1000).WithAlgorithm(SlidingWindow)
+	data, err := json.Marshal(l)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"global": "10MiB/s burst 1MiB", "conn": "1kB/s algorithm sliding-window"}`, string(data))
+
+	var decoded limits
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, l, decoded)
+
+	require.Error(t, json.Unmarshal([]byte(`{"global": "fast"}`), &decoded))
+
+	// Zero config is a missing limit, so it is kept missing.
+	assert.Equal(t, "", Config{}.String())
+	expected := FileConfig{
+		Conn:    NewConfig(1000),
+		Classes: map[string]ClassFileConfig{"internal": {Limit: NewConfig(100)}},
+	}
+	data, err = json.Marshal(expected)
+	require.NoError(t, err)
+	var fc FileConfig
+	require.NoError(t, json.Unmarshal(data, &fc))
+	require.NoError(t, fc.Validate())
+	assert.Equal(t, expected, fc)
+}
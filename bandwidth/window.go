@@ -0,0 +1,180 @@
+package bandwidth
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// windowSlots is a number of time slots in a window of sliding window limiter.
+// Reservations in the same slot are kept as one entry, so a number of entries does not grow with a number of reservations.
+const windowSlots = 100
+
+// slidingWindow is a sliding window rate limiter, which allows for at most burst bytes in any window
+// of burst/limit seconds. It keeps a log of reservations, so bytes are counted until they leave the window.
+// Reservations within 1/windowSlots of the window are merged, and merged bytes leave the window with the latest of them.
+type slidingWindow struct {
+	mutex sync.Mutex
+	limit rate.Limit
+	burst int
+	// entries are reservations in the current window and in the future, in order of their times.
+	entries []*windowEntry
+}
+
+// windowEntry is a number of bytes used in a time slot, which starts at time start.
+// Bytes are counted as used at time at, which is the time of the latest of them.
+type windowEntry struct {
+	start time.Time
+	at    time.Time
+	n     int
+}
+
+// newSlidingWindow returns empty sliding window for a given config.
+func newSlidingWindow(c Config) *slidingWindow {
+	return &slidingWindow{limit: c.limit, burst: c.burst}
+}
+
+// Config returns current config of the sliding window.
+func (sw *slidingWindow) Config() Config {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	return Config{limit: sw.limit, burst: sw.burst, algorithm: SlidingWindow}
+}
+
+// SetConfig sets new limit and burst, which also changes the length of the window.
+// Bytes which have been already reserved are not affected.
+func (sw *slidingWindow) SetConfig(_ time.Time, c Config) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	sw.limit = c.limit
+	sw.burst = c.burst
+}
+
+// IsFull returns true when all reserved bytes have left the window at time now.
+func (sw *slidingWindow) IsFull(now time.Time) bool {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.limit == rate.Inf || len(sw.entries) == 0 {
+		return true
+	}
+
+	return !sw.entries[len(sw.entries)-1].at.Add(sw.window()).After(now)
+}
+
+// ReserveN reserves n bytes at time now. Bytes can be used when they do not exceed the burst
+// together with bytes used in the window which ends at that time.
+// It returns an error when n exceeds the burst.
+func (sw *slidingWindow) ReserveN(now time.Time, n int) (*Reservation, error) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.limit == rate.Inf {
+		return &Reservation{tokens: n, timeToAct: now}, nil
+	}
+
+	if n > sw.burst {
+		return nil, fmt.Errorf("bandwidth: can not reserve %d bytes, because it exceeds burst %d", n, sw.burst)
+	}
+
+	at := sw.timeToAct(now, n)
+	entry := sw.add(at, n)
+	r := &Reservation{
+		tokens:    n,
+		timeToAct: at,
+		refunds: []func(n int){func(n int) {
+			sw.returnN(entry, n)
+		}},
+	}
+
+	return r, nil
+}
+
+// Delay returns how long it takes until n bytes can be used at time now.
+// It returns zero when n exceeds the burst, because such reservation fails immediately.
+func (sw *slidingWindow) Delay(now time.Time, n int) time.Duration {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.limit == rate.Inf || n > sw.burst {
+		return 0
+	}
+
+	return sw.timeToAct(now, n).Sub(now)
+}
+
+// timeToAct returns the first time, not before time now and previous reservations, when n bytes can be used.
+// Entries which have left the window before time now are removed. It requires that mutex is held.
+func (sw *slidingWindow) timeToAct(now time.Time, n int) time.Time {
+	window := sw.window()
+	for len(sw.entries) > 0 && !sw.entries[0].at.Add(window).After(now) {
+		sw.entries = sw.entries[1:]
+	}
+
+	t := now
+	if len(sw.entries) > 0 && sw.entries[len(sw.entries)-1].at.After(t) {
+		// Reservations are served in order.
+		t = sw.entries[len(sw.entries)-1].at
+	}
+
+	// used is a number of bytes in the window which ends at time t, and first is its oldest entry.
+	used, first := 0, 0
+	for i, entry := range sw.entries {
+		if !entry.at.Add(window).After(t) {
+			first = i + 1
+			continue
+		}
+		used += entry.n
+	}
+
+	// Bytes can be used when the oldest entries leave the window.
+	for used+n > sw.burst && first < len(sw.entries) {
+		t = sw.entries[first].at.Add(window)
+		used -= sw.entries[first].n
+		first++
+	}
+
+	return t
+}
+
+// add adds n bytes used at a given time, which is not before the last entry, and returns their entry.
+// Bytes are added to the last entry when it is in the same time slot. It requires that mutex is held.
+func (sw *slidingWindow) add(at time.Time, n int) *windowEntry {
+	if len(sw.entries) > 0 {
+		last := sw.entries[len(sw.entries)-1]
+		if at.Sub(last.start) < sw.window()/windowSlots {
+			last.at = at
+			last.n += n
+
+			return last
+		}
+	}
+
+	entry := &windowEntry{start: at, at: at, n: n}
+	sw.entries = append(sw.entries, entry)
+
+	return entry
+}
+
+// returnN returns n unused bytes of a given entry. The entry is removed when all its bytes are returned.
+func (sw *slidingWindow) returnN(entry *windowEntry, n int) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	entry.n -= min(n, entry.n)
+	if entry.n == 0 {
+		if i := slices.Index(sw.entries, entry); i >= 0 {
+			sw.entries = slices.Delete(sw.entries, i, i+1)
+		}
+	}
+}
+
+// window returns the length of the window. It requires that mutex is held.
+func (sw *slidingWindow) window() time.Duration {
+	return durationFromTokens(sw.limit, float64(sw.burst))
+}
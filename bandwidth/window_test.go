@@ -0,0 +1,76 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindowReserveN(t *testing.T) {
+	sw := newSlidingWindow(NewConfig(10))
+	now := time.Now()
+
+	r, err := sw.ReserveN(now, 6)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct)
+	r, err = sw.ReserveN(now.Add(500*time.Millisecond), 4)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(500*time.Millisecond), r.timeToAct)
+
+	// Bytes can be used when the oldest bytes leave the window.
+	r, err = sw.ReserveN(now.Add(600*time.Millisecond), 5)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Second), r.timeToAct)
+	assert.Equal(t, 400*time.Millisecond, sw.Delay(now.Add(600*time.Millisecond), 1))
+	assert.Equal(t, 900*time.Millisecond, sw.Delay(now.Add(600*time.Millisecond), 2))
+
+	// Next reservations are served in order.
+	r, err = sw.ReserveN(now.Add(600*time.Millisecond), 2)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(1500*time.Millisecond), r.timeToAct)
+
+	assert.False(t, sw.IsFull(now.Add(2*time.Second)))
+	assert.True(t, sw.IsFull(now.Add(2500*time.Millisecond)))
+
+	_, err = sw.ReserveN(now, 11)
+	require.Error(t, err, "it must not be possible to reserve more than burst")
+}
+
+func TestSlidingWindowReturnN(t *testing.T) {
+	sw := newSlidingWindow(NewConfig(10))
+	now := time.Now()
+
+	r, err := sw.ReserveN(now, 10)
+	require.NoError(t, err)
+	r.ReturnN(4)
+
+	r, err = sw.ReserveN(now, 4)
+	require.NoError(t, err)
+	assert.Equal(t, now, r.timeToAct, "returned bytes must be available immediately")
+	assert.Len(t, sw.entries, 1, "reservations in the same time slot must be merged")
+
+	// Entry without bytes is removed.
+	r.ReturnN(4)
+	r, err = sw.ReserveN(now.Add(500*time.Millisecond), 4)
+	require.NoError(t, err)
+	r.ReturnN(4)
+	assert.Len(t, sw.entries, 1)
+	assert.Equal(t, 6, sw.entries[0].n)
+}
+
+func TestSlidingWindowEntries(t *testing.T) {
+	sw := newSlidingWindow(NewConfig(1000))
+	now := time.Now()
+
+	// Many small reservations are kept in at most one entry per time slot.
+	for i := 0; i < 1000; i++ {
+		_, err := sw.ReserveN(now.Add(time.Duration(i)*time.Millisecond), 1)
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, len(sw.entries), windowSlots)
+
+	// Window is full, so next bytes can be used when the latest bytes of the oldest slot leave the window.
+	assert.Equal(t, 10*time.Millisecond, sw.Delay(now.Add(999*time.Millisecond), 1))
+}